@@ -0,0 +1,92 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// sidecar 与文件一起转正的附属文件，保存在同目录下，文件名为原文件名加ext，
+// 保留原扩展名，同名的图片与视频的sidecar不会互相覆盖。
+type sidecar struct {
+	ext  string
+	data []byte
+}
+
+func sidecarPath(path, ext string) string {
+	return path + ext
+}
+
+// commitFile 把tmp文件及其sidecar转正为dst并记录到索引。
+// 先写入Pending记录，再fsync文件并原子地rename，最后把记录标记为完成；
+// 中途崩溃留下的Pending记录由recoverPending在下次启动时修复。
+func commitFile(r *Record, tmp, dst string, sidecars []sidecar) error {
+	r.Path = dst
+	r.Pending = true
+	err := index.put(r)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	// sidecar先于文件转正，崩溃时最多留下没有对应文件的sidecar，重新下载时会被覆盖。
+	// 失败时只删除本次新建的sidecar，替换已有文件时原来的sidecar保留。
+	var created []string
+	for _, s := range sidecars {
+		p := sidecarPath(dst, s.ext)
+		_, statErr := os.Stat(p)
+		err = ioutil.WriteFile(p+".tmp", s.data, 0644)
+		if err == nil {
+			err = promoteFile(p+".tmp", p)
+		}
+		if err != nil {
+			_ = os.Remove(p + ".tmp")
+			break
+		}
+		if os.IsNotExist(statErr) {
+			created = append(created, p)
+		}
+	}
+
+	if err == nil {
+		err = promoteFile(tmp, dst)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		for _, p := range created {
+			_ = os.Remove(p)
+		}
+		_ = index.delete(r.Key)
+		return err
+	}
+
+	r.Pending = false
+	return index.put(r)
+}
+
+// promoteFile 把文件内容刷到磁盘后rename为dst，并fsync所在目录使rename持久化。
+func promoteFile(tmp, dst string) error {
+	err := syncFile(tmp)
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(tmp, dst)
+	if err != nil {
+		return err
+	}
+
+	return syncFile(filepath.Dir(dst))
+}
+
+func syncFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	return f.Sync()
+}
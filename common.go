@@ -5,6 +5,7 @@ import (
 	"github.com/mmcdole/gofeed"
 	"regexp"
 	"strings"
+	"time"
 )
 
 type Parser func(item *gofeed.Item, seed string) []*oneItem
@@ -88,16 +89,7 @@ func parseDouyinVideo(item *gofeed.Item, seed string) []*oneItem {
 
 	urlDecoded := strings.Replace(ss[0][1], "&amp;", "&", -1)
 	it := &oneItem{url: urlDecoded, desc: des}
-	replacer := strings.NewReplacer(
-		"!", "_", "@", "_", "#", "_",
-		"$", "_", "%", "_", "^", "_", "*", "_",
-		"&", "_", ".", "_", ",", "_",
-		"\\", "_", "/", "_", "|", "_",
-		"~", "_", "?", "_", "]", "_",
-		"[", "_", "{", "_", "}", "_",
-		"<", "_", ">", "_", "|", " ",
-	)
-	title := replacer.Replace(item.Title)
+	title := sanitizeName(item.Title)
 
 	prefix := seed
 	if len(seed) > 5 {
@@ -137,3 +129,14 @@ func parseDailyArt(item *gofeed.Item, seed string) []*oneItem {
 
 	return []*oneItem{it}
 }
+
+// publishedTime 返回条目的发布时间，没有时使用更新时间，都没有时返回零值。
+func publishedTime(item *gofeed.Item) time.Time {
+	if item.PublishedParsed != nil {
+		return *item.PublishedParsed
+	}
+	if item.UpdatedParsed != nil {
+		return *item.UpdatedParsed
+	}
+	return time.Time{}
+}
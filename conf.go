@@ -2,12 +2,14 @@ package main
 
 import (
 	"fmt"
+	"golang.org/x/time/rate"
 	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"time"
 )
 
 const (
@@ -16,7 +18,9 @@ const (
 	ThirtyFivePhotoUrl = "https://rsshub.rssforever.com/35photo"
 	RsshubDouyinUrl    = "https://rsshub.codefine.site:6870/douyin/user"
 	DefaultDir         = "."
+	DefaultWorkers     = 20
 
+	Twitter            = "twitter"
 	Douyin             = "douyin"
 	ThirtyFivePhotoRss = "35photo"
 	TelegramChannelRss = "telegramchannel"
@@ -42,6 +46,63 @@ type Account struct {
 	Url             string   `yaml:"url"`
 	FeedUseProxy    bool     `yaml:"feed_use_proxy"`
 	ContentUseProxy bool     `yaml:"content_use_proxy"`
+
+	// serve模式下的调度配置，cron优先于interval，未配置时使用全局配置。
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Cron     string        `yaml:"cron,omitempty"`
+	Jitter   time.Duration `yaml:"jitter,omitempty"`
+
+	// 账号内所有请求共享的限速。
+	RateLimit RateLimit `yaml:"rate_limit,omitempty"`
+	// 账号的重试策略，未配置的项使用全局配置。
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+	// 与已下载文件内容相同时的处理方式：skip、hardlink、symlink、keep，未配置时使用全局配置。
+	DuplicateAction string `yaml:"duplicate_action,omitempty"`
+	// 已存在同名文件时的处理策略：size、resolution、newest、keep_both，未配置时使用全局配置。
+	// 只用于不属于其他条目的已有文件，例如索引之前下载或手动放入的文件；属于其他条目的同名文件总是加数字后缀。
+	ReplacePolicy string `yaml:"replace_policy,omitempty"`
+	// 描述信息的格式：raw(原始HTML)、text(纯文本)、title(仅标题)，未配置时使用全局配置。
+	DescMode string `yaml:"desc_mode,omitempty"`
+	// 写入EXIF的版权信息，未配置时使用全局配置。
+	Copyright string `yaml:"copyright,omitempty"`
+	// 写入描述信息时删除原图中的相机型号、序列号、GPS等信息。
+	StripCameraTags bool `yaml:"strip_camera_tags,omitempty"`
+	// 写入XMP元数据的方式：embed(写入JPEG/PNG文件内)、sidecar(生成原文件名加.xmp的文件)，未配置时不写入。
+	Xmp string `yaml:"xmp,omitempty"`
+	// 为每个文件生成记录来源条目信息的.json文件，文件名为原文件名加.json，如a.jpg.json。
+	JsonSidecar bool `yaml:"json_sidecar,omitempty"`
+	// 视频的过滤规则，未配置的项使用全局配置。
+	VideoFilter VideoFilter `yaml:"video_filter,omitempty"`
+	// 文件名模板，支持{seed}、{date}、{published}、{published:2006-01-02}、{title}、{guid_hash}、{index}、{ext}，
+	// 未配置时为<seed>_<md5>.<ext>。
+	FilenameTemplate string `yaml:"filename_template,omitempty"`
+	// 目录模板，支持{dir}、{seed}、{type}、{date}、{published}、{published:2006}，/分隔子目录，
+	// {date}与{published}为条目的发布时间，没有时为运行时间；未配置时使用全局配置，
+	// 都未配置时twitter为{dir}/{date}(no_date时为{dir})，telegram与35photo为{dir}/{date}，其他类型为{dir}。
+	DirTemplate string `yaml:"dir_template,omitempty"`
+
+	limiter *rate.Limiter
+}
+
+// RateLimit 令牌桶限速，rate为每秒请求数，burst为桶容量，rate为0表示不限速。
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+func (a *Account) rateLimiter() *rate.Limiter {
+	if a.limiter == nil {
+		a.limiter = newRateLimiter(a.RateLimit)
+	}
+	return a.limiter
+}
+
+func (a *Account) name() string {
+	t := a.Type
+	if t == "" {
+		t = Twitter
+	}
+	return fmt.Sprintf("%s:%s", t, a.Dir)
 }
 
 type HttpProxy struct {
@@ -58,6 +119,109 @@ type Conf struct {
 	Proxy     HttpProxy `yaml:"http_proxy"`
 	RssHubUrl string    `yaml:"rsshub_url"`
 	PhotoDir  string    `yaml:"photo_dir"`
+
+	Interval time.Duration `yaml:"interval,omitempty"`
+	Jitter   time.Duration `yaml:"jitter,omitempty"`
+
+	// 收到退出信号后等待进行中下载完成的最长时间。
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout,omitempty"`
+
+	// 并发下载的协程数，以及每个host的最大并发请求数，0表示不限制。
+	Workers          int            `yaml:"workers,omitempty"`
+	DefaultHostLimit int            `yaml:"default_host_limit,omitempty"`
+	HostLimits       map[string]int `yaml:"host_limits,omitempty"`
+	// 写入描述信息时全局最多读入内存的文件大小。
+	MaxMemoryMB int `yaml:"max_memory_mb,omitempty"`
+
+	// 每个host的令牌桶限速。
+	DefaultRateLimit RateLimit            `yaml:"default_rate_limit,omitempty"`
+	RateLimits       map[string]RateLimit `yaml:"rate_limits,omitempty"`
+
+	Retry RetryPolicy `yaml:"retry,omitempty"`
+
+	DuplicateAction string `yaml:"duplicate_action,omitempty"`
+
+	// 感知hash的汉明距离不超过该值时视为近似图片，0表示不检测；近似图片中分辨率较低的一张按near_duplicate_action处理。
+	PHashThreshold      int    `yaml:"phash_threshold,omitempty"`
+	NearDuplicateAction string `yaml:"near_duplicate_action,omitempty"`
+
+	ReplacePolicy string `yaml:"replace_policy,omitempty"`
+
+	DescMode string `yaml:"desc_mode,omitempty"`
+
+	// 写入EXIF的版权信息，未配置时为"© 种子名"。
+	Copyright string `yaml:"copyright,omitempty"`
+
+	VideoFilter VideoFilter `yaml:"video_filter,omitempty"`
+
+	// 所有账号默认的目录模板，账号可通过dir_template单独配置。
+	DirTemplate string `yaml:"dir_template,omitempty"`
+}
+
+func (c *Conf) videoFilter(a *Account) VideoFilter {
+	return c.VideoFilter.merge(a.VideoFilter)
+}
+
+func (c *Conf) descMode(a *Account) string {
+	if a.DescMode != "" {
+		return a.DescMode
+	}
+	if c.DescMode != "" {
+		return c.DescMode
+	}
+	return DescText
+}
+
+// dirTemplate 返回账号的目录模板，def为该类型账号默认的模板。
+func (c *Conf) dirTemplate(a *Account, def string) string {
+	if a.DirTemplate != "" {
+		return a.DirTemplate
+	}
+	if c.DirTemplate != "" {
+		return c.DirTemplate
+	}
+	return def
+}
+
+func (c *Conf) copyright(a *Account, seed string) string {
+	if a.Copyright != "" {
+		return a.Copyright
+	}
+	if c.Copyright != "" {
+		return c.Copyright
+	}
+	return "© " + seed
+}
+
+func (c *Conf) replacePolicy(a *Account) string {
+	if a.ReplacePolicy != "" {
+		return a.ReplacePolicy
+	}
+	if c.ReplacePolicy != "" {
+		return c.ReplacePolicy
+	}
+	return ReplaceBySize
+}
+
+func (c *Conf) nearDuplicateAction() string {
+	if c.NearDuplicateAction != "" {
+		return c.NearDuplicateAction
+	}
+	return NearDuplicateQuarantine
+}
+
+func (c *Conf) duplicateAction(a *Account) string {
+	if a.DuplicateAction != "" {
+		return a.DuplicateAction
+	}
+	if c.DuplicateAction != "" {
+		return c.DuplicateAction
+	}
+	return DuplicateSkip
+}
+
+func (c *Conf) retryPolicy(a *Account) RetryPolicy {
+	return defaultRetryPolicy().merge(c.Retry).merge(a.Retry)
 }
 
 func formatConf(fPath string) error {
@@ -103,6 +267,62 @@ func formatConf(fPath string) error {
 	return nil
 }
 
+// checkConf 校验配置，未知的type直接报错，避免账号被静默忽略。
+func checkConf(c *Conf) error {
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		if _, err := getSource(a.Type); err != nil {
+			return fmt.Errorf("account dir: %s, %s", a.Dir, err.Error())
+		}
+
+		if _, err := newSchedule(a, c); err != nil {
+			return err
+		}
+
+		if err := checkDuplicateAction(a.DuplicateAction); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+
+		if err := checkReplacePolicy(a.ReplacePolicy); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+
+		if err := checkDescMode(a.DescMode); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+
+		if err := checkXmpMode(a.Xmp); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+
+		if err := checkTemplate("filename_template", a.FilenameTemplate, fileNamePlaceholders); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+
+		if err := checkTemplate("dir_template", a.DirTemplate, dirPlaceholders); err != nil {
+			return fmt.Errorf("account %s, %s", a.name(), err.Error())
+		}
+	}
+
+	if err := checkReplacePolicy(c.ReplacePolicy); err != nil {
+		return err
+	}
+
+	if err := checkDescMode(c.DescMode); err != nil {
+		return err
+	}
+
+	if err := checkTemplate("dir_template", c.DirTemplate, dirPlaceholders); err != nil {
+		return err
+	}
+
+	if err := checkDuplicateAction(c.DuplicateAction); err != nil {
+		return err
+	}
+
+	return checkNearDuplicateAction(c.NearDuplicateAction)
+}
+
 func getConf(fPath string) (*Conf, error) {
 	c := Conf{}
 
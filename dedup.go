@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// 内容相同（sha256一致）的文件重复下载时的处理方式。
+const (
+	DuplicateSkip     = "skip"
+	DuplicateHardlink = "hardlink"
+	DuplicateSymlink  = "symlink"
+	DuplicateKeep     = "keep"
+)
+
+func checkDuplicateAction(action string) error {
+	switch action {
+	case "", DuplicateSkip, DuplicateHardlink, DuplicateSymlink, DuplicateKeep:
+		return nil
+	}
+	return fmt.Errorf("invalid duplicate_action: %q", action)
+}
+
+// linkDuplicate 按action把dst指向已有的文件first，返回该条目最终对应的文件路径。
+// skip时不在dst生成任何文件，直接返回first。
+func linkDuplicate(action, first, dst string) (string, error) {
+	if action != DuplicateHardlink && action != DuplicateSymlink {
+		return first, nil
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		return dst, nil
+	}
+
+	if action == DuplicateHardlink {
+		return dst, os.Link(first, dst)
+	}
+
+	target, err := filepath.Rel(filepath.Dir(dst), first)
+	if err != nil {
+		target = first
+	}
+	return dst, os.Symlink(target, dst)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"golang.org/x/net/html"
+	"regexp"
+	"strings"
+)
+
+// 写入文件的描述信息的格式。
+const (
+	// DescRaw 原样保存RSS中的HTML描述。
+	DescRaw = "raw"
+	// DescText 把HTML描述转换为纯文本，链接展开为完整URL。
+	DescText = "text"
+	// DescTitle 只保存条目标题。
+	DescTitle = "title"
+)
+
+var (
+	hashtagReg = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_&/])#([\p{L}\p{N}_]+)`)
+	mentionReg = regexp.MustCompile(`(?:^|[^\p{L}\p{N}_.@/])@([\p{L}\p{N}_]+)`)
+	spaceReg   = regexp.MustCompile(`[ \t\p{Zs}]+`)
+)
+
+func checkDescMode(mode string) error {
+	switch mode {
+	case "", DescRaw, DescText, DescTitle:
+		return nil
+	}
+	return fmt.Errorf("invalid desc_mode: %q", mode)
+}
+
+// describe 按mode生成条目的描述，并从正文中提取hashtag与mention。
+func describe(item *oneItem, fi *gofeed.Item, mode string) {
+	text := htmlToText(fi.Description)
+	item.title = strings.TrimSpace(fi.Title)
+	item.link = fi.Link
+	item.postGUID = fi.GUID
+	item.author = itemAuthor(fi)
+	item.hashtags = findTags(hashtagReg, text)
+	item.mentions = findTags(mentionReg, text)
+
+	switch mode {
+	case DescRaw:
+	case DescTitle:
+		item.desc = item.title
+		if item.desc == "" {
+			item.desc = text
+		}
+	default:
+		item.desc = text
+		if item.desc == "" {
+			item.desc = item.title
+		}
+	}
+}
+
+func itemAuthor(fi *gofeed.Item) string {
+	for _, a := range fi.Authors {
+		if a != nil && a.Name != "" {
+			return a.Name
+		}
+	}
+	if fi.Author != nil {
+		return fi.Author.Name
+	}
+	return ""
+}
+
+// htmlToText 把HTML转换为纯文本：去掉图片、脚本和样式，块级元素与<br>转换为换行，链接展开为完整URL。
+func htmlToText(s string) string {
+	if !strings.Contains(s, "<") {
+		return strings.TrimSpace(html.UnescapeString(s))
+	}
+
+	var (
+		b    strings.Builder
+		skip int
+		// 当前链接的href与其中的文本。
+		href   string
+		anchor *strings.Builder
+	)
+	z := html.NewTokenizer(strings.NewReader(s))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+
+		t := z.Token()
+		switch tt {
+		case html.TextToken:
+			if skip > 0 {
+				continue
+			}
+			if anchor != nil {
+				anchor.WriteString(t.Data)
+			} else {
+				b.WriteString(t.Data)
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			switch t.Data {
+			case "script", "style":
+				if tt == html.StartTagToken {
+					skip++
+				}
+			case "br", "p", "div", "li", "tr", "blockquote", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n")
+			case "a":
+				if tt == html.StartTagToken {
+					href, anchor = attr(t, "href"), &strings.Builder{}
+				}
+			}
+		case html.EndTagToken:
+			switch t.Data {
+			case "script", "style":
+				if skip > 0 {
+					skip--
+				}
+			case "p", "div", "li", "tr", "blockquote", "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n")
+			case "a":
+				if anchor != nil {
+					b.WriteString(expandLink(anchor.String(), href))
+					href, anchor = "", nil
+				}
+			}
+		}
+	}
+	if anchor != nil {
+		b.WriteString(expandLink(anchor.String(), href))
+	}
+
+	var lines []string
+	for _, l := range strings.Split(b.String(), "\n") {
+		l = strings.TrimSpace(spaceReg.ReplaceAllString(l, " "))
+		if l != "" {
+			lines = append(lines, l)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func attr(t html.Token, key string) string {
+	for _, a := range t.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// expandLink 链接文本是被截断的URL时替换为完整URL，hashtag与mention保持原样，其他文本后附上URL。
+func expandLink(text, href string) string {
+	text = strings.TrimSpace(text)
+	if href == "" || strings.HasPrefix(href, "#") || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "@") {
+		return text
+	}
+
+	if text == "" || strings.HasPrefix(text, "http") || strings.HasSuffix(text, "…") ||
+		(!strings.ContainsAny(text, " \t") && strings.Contains(text, ".") && strings.Contains(text, "/")) {
+		return href
+	}
+	return fmt.Sprintf("%s (%s)", text, href)
+}
+
+// findTags 返回正则第一个分组的所有匹配，去重并保持出现的顺序。
+func findTags(reg *regexp.Regexp, text string) []string {
+	var (
+		tags []string
+		seen = map[string]bool{}
+	)
+	for _, m := range reg.FindAllStringSubmatch(text, -1) {
+		if !seen[m[1]] {
+			seen[m[1]] = true
+			tags = append(tags, m[1])
+		}
+	}
+	return tags
+}
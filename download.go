@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const DefaultMaxMemoryMB = 256
+
+// memBudget 限制全局同时读入内存的字节数，单个请求超过上限时按上限计算。
+type memBudget struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	max  int64
+	used int64
+}
+
+var memory *memBudget
+
+func newMemBudget(max int64) *memBudget {
+	b := &memBudget{max: max}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *memBudget) acquire(n int64) int64 {
+	if n > b.max {
+		n = b.max
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for b.used+n > b.max {
+		b.cond.Wait()
+	}
+	b.used += n
+	return n
+}
+
+func (b *memBudget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+// partialMeta 记录未下载完成的文件对应的url及校验信息，用于断点续传。
+type partialMeta struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Size         int64  `json:"size"`
+	AcceptRanges bool   `json:"accept_ranges"`
+	ContentType  string `json:"content_type,omitempty"`
+}
+
+func loadPartialMeta(path string) *partialMeta {
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	m := &partialMeta{}
+	if json.Unmarshal(d, m) != nil {
+		return nil
+	}
+	return m
+}
+
+func (m *partialMeta) resumable(u string) bool {
+	return m != nil && m.URL == u && m.AcceptRanges && (m.ETag != "" || m.LastModified != "")
+}
+
+func newPartialMeta(u string, res *http.Response) *partialMeta {
+	return &partialMeta{
+		URL:          u,
+		ETag:         res.Header.Get("ETag"),
+		LastModified: res.Header.Get("Last-Modified"),
+		Size:         res.ContentLength,
+		AcceptRanges: res.Header.Get("Accept-Ranges") == "bytes",
+		ContentType:  res.Header.Get("Content-Type"),
+	}
+}
+
+func removePartial(path string) {
+	_ = os.Remove(path)
+	_ = os.Remove(path + ".json")
+}
+
+// downloadToFile 把u的内容直接流式写入path，不在内存中缓存整个文件。
+// 下载中断时保留已下载的部分和path.json中的url、ETag等信息，下次服务端支持时通过Range续传，
+// 下载完成后校验文件大小与Content-Length一致，返回响应的Content-Type。
+func downloadToFile(ctx context.Context, c *http.Client, u string, path string) (string, error) {
+	metaPath := path + ".json"
+	meta := loadPartialMeta(metaPath)
+	contentType := ""
+	if meta != nil {
+		contentType = meta.ContentType
+	}
+
+	var offset int64
+	if meta.resumable(u) {
+		if st, err := os.Stat(path); err == nil {
+			offset = st.Size()
+		}
+	}
+
+	if offset > 0 && offset == meta.Size {
+		_ = os.Remove(metaPath)
+		return contentType, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		if meta.ETag != "" {
+			req.Header.Set("If-Range", meta.ETag)
+		} else {
+			req.Header.Set("If-Range", meta.LastModified)
+		}
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer func(b io.ReadCloser) {
+		_ = b.Close()
+	}(res.Body)
+
+	flag := os.O_WRONLY | os.O_CREATE
+	contentType = res.Header.Get("Content-Type")
+	switch {
+	case res.StatusCode == http.StatusPartialContent && offset > 0 && contentRangeStart(res) == offset:
+		flag |= os.O_APPEND
+		log.Warnf("resume download: %s from %d/%d bytes", u, offset, meta.Size)
+	case res.StatusCode == http.StatusOK:
+		// 服务端不支持续传或者文件已变化，从头下载。
+		flag |= os.O_TRUNC
+		offset = 0
+		meta = newPartialMeta(u, res)
+		d, _ := json.Marshal(meta)
+		err = ioutil.WriteFile(metaPath, d, 0755)
+		if err != nil {
+			return "", err
+		}
+	default:
+		if res.StatusCode == http.StatusRequestedRangeNotSatisfiable || res.StatusCode == http.StatusPartialContent {
+			removePartial(path)
+			// 续传的范围不被接受时，删除已下载的部分后立即不带Range重新下载。
+			if offset > 0 {
+				_ = res.Body.Close()
+				log.Warnf("failed to resume download: %s, http status: %d, download again", u, res.StatusCode)
+				return downloadToFile(ctx, c, u, path)
+			}
+		}
+		return "", newStatusError(res)
+	}
+
+	f, err := os.OpenFile(path, flag, 0755)
+	if err != nil {
+		return "", err
+	}
+
+	n, err := io.Copy(f, res.Body)
+	if err != nil {
+		_ = f.Close()
+		return "", err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if meta.Size >= 0 && offset+n != meta.Size {
+		if offset+n > meta.Size {
+			removePartial(path)
+		}
+		return "", fmt.Errorf("%s, got %d bytes, expect %d bytes: %w", u, offset+n, meta.Size, io.ErrUnexpectedEOF)
+	}
+
+	_ = os.Remove(metaPath)
+	return contentType, nil
+}
+
+// contentRangeStart 解析Content-Range: bytes start-end/total中的start。
+func contentRangeStart(res *http.Response) int64 {
+	var start, end, total int64
+	_, err := fmt.Sscanf(res.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &total)
+	if err != nil {
+		return -1
+	}
+	return start
+}
+
+// sniffFile 读取文件头判断文件类型。
+func sniffFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+
+	return getFileType(head[:n]), nil
+}
+
+// addDescToFile 从磁盘读入已下载的图片写入描述信息与内嵌的XMP后写回，读入的内存受max_memory_mb限制；
+// 视频只重写moov中的元数据。
+func addDescToFile(item *oneItem, user *OneUser, path string, ft string) error {
+	if hasMp4Meta(ft) {
+		if user.noDesc {
+			return nil
+		}
+		// 视频写入元数据失败时保留原文件。
+		err := writeMp4Tags(path, mp4Tags(item, user))
+		if err != nil {
+			log.Warnf("failed to write mp4 tags: %s, err: %s", path, err.Error())
+		}
+		return nil
+	}
+
+	embed := user.acc.Xmp == XmpEmbed
+	if !hasDescSupport(ft) || (user.noDesc && !embed) {
+		return nil
+	}
+
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	// 解析和重新编码时原文件与新文件同时在内存中。
+	n := memory.acquire(st.Size() * 2)
+	defer memory.release(n)
+
+	pic, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	pic, err = addDesc(item, user, pic, ft)
+	if err != nil {
+		return err
+	}
+
+	if embed {
+		x, err := embedXmp(pic, ft, buildXmp(item, user))
+		if err != nil {
+			log.Warnf("failed to embed xmp: %s, err: %s", path, err.Error())
+		} else {
+			pic = x
+		}
+	}
+
+	return ioutil.WriteFile(path, pic, 0755)
+}
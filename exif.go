@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/dsoprea/go-exif/v3"
+	exifcommon "github.com/dsoprea/go-exif/v3/common"
+	"github.com/dsoprea/go-exif/v3/undefined"
+	jpgs "github.com/dsoprea/go-jpeg-image-structure/v2"
+	log "github.com/sirupsen/logrus"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// 配置strip_camera_tags时删除的IFD0中的标签：Make、Model、Software、HostComputer和GPS信息。
+var strippedRootTags = []uint16{0x010f, 0x0110, 0x0131, 0x013c, 0x8825}
+
+// 配置strip_camera_tags时删除的Exif IFD中的标签：CameraOwnerName、BodySerialNumber以及镜头信息。
+var strippedExifTags = []uint16{0xa430, 0xa431, 0xa432, 0xa433, 0xa434, 0xa435}
+
+// maxJpegSegment JPEG段的长度字段为16位，包含长度字段自身的2字节。
+const maxJpegSegment = 0xFFFF
+
+// exifByteOrder 返回原图EXIF的字节序，没有EXIF时使用默认字节序。
+func exifByteOrder(rootIfd *exif.Ifd, _ []byte, err error) binary.ByteOrder {
+	if err != nil || rootIfd == nil {
+		return exifcommon.EncodeDefaultByteOrder
+	}
+	return rootIfd.ByteOrder()
+}
+
+// encodeUtf16 把字符串编码为UCS-2字节序列。
+func encodeUtf16(s string, bo binary.ByteOrder) []byte {
+	u := utf16.Encode([]rune(s))
+	b := make([]byte, len(u)*2)
+	for i, c := range u {
+		bo.PutUint16(b[i*2:], c)
+	}
+	return b
+}
+
+// addExif 写入描述、作者、发布时间与版权信息，原图中已有的相机信息默认保留。
+func addExif(item *oneItem, user *OneUser, rootIb *exif.IfdBuilder, bo binary.ByteOrder) (*exif.IfdBuilder, error) {
+	if rootIb == nil {
+		im, err := exifcommon.NewIfdMappingWithStandard()
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		ti := exif.NewTagIndex()
+		rootIb = exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, bo)
+	}
+
+	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if user.acc != nil && user.acc.StripCameraTags {
+		for _, id := range strippedRootTags {
+			_, _ = rootIb.DeleteAll(id)
+		}
+		for _, id := range strippedExifTags {
+			_, _ = exifIb.DeleteAll(id)
+		}
+	}
+
+	uc := exifundefined.Tag9286UserComment{
+		EncodingType:  exifundefined.TagUndefinedType_9286_UserComment_Encoding_UNICODE,
+		EncodingBytes: encodeUtf16(item.desc, bo),
+	}
+	err = exifIb.SetStandardWithName("UserComment", uc)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	// 相机记录的拍摄时间优先，没有时使用条目的发布时间。
+	if _, err := exifIb.FindTagWithName("DateTimeOriginal"); err != nil && !item.published.IsZero() {
+		err = exifIb.SetStandardWithName("DateTimeOriginal", item.published.Local().Format("2006:01:02 15:04:05"))
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+
+	copyright := "© " + user.account
+	if user.acc != nil {
+		copyright = config.copyright(user.acc, user.account)
+	}
+
+	// ImageDescription、Artist、Copyright为ASCII类型，按惯例写入UTF-8；XPComment固定为UTF-16LE。
+	tags := []struct {
+		name  string
+		value interface{}
+	}{
+		{"ImageDescription", item.desc},
+		{"Artist", user.account},
+		{"Copyright", copyright},
+		{"XPComment", append(encodeUtf16(item.desc, binary.LittleEndian), 0, 0)},
+	}
+	for _, t := range tags {
+		err = rootIb.SetStandardWithName(t.name, t.value)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+	}
+	return rootIb, nil
+}
+
+// setJpegExif 写入EXIF，APP1段超过64KB时截短描述后重试，描述在段内以UTF-16和UTF-8共保存三份。
+func setJpegExif(sl *jpgs.SegmentList, item *oneItem, user *OneUser) error {
+	rootIb, _ := sl.ConstructExifBuilder()
+	bo := exifByteOrder(sl.Exif())
+	it := *item
+	desc := []rune(item.desc)
+	for {
+		it.desc = string(desc)
+		ib, err := addExif(&it, user, rootIb, bo)
+		if err != nil {
+			return err
+		}
+		rootIb = ib
+
+		err = sl.SetExif(rootIb)
+		if err != nil {
+			return err
+		}
+
+		_, s, err := sl.FindExif()
+		if err != nil {
+			return err
+		}
+		over := len(s.Data) + 2 - maxJpegSegment
+		if over <= 0 {
+			if len(desc) < len([]rune(item.desc)) {
+				log.Warnf("description truncated to %d characters to fit the exif segment", len(desc))
+			}
+			return nil
+		}
+		if len(desc) == 0 {
+			return fmt.Errorf("exif segment too large: %d bytes", len(s.Data)+2)
+		}
+
+		desc = trimDesc(desc, over)
+	}
+}
+
+// trimDesc 从末尾截掉至少占n字节的字符，每个字符在两份UTF-16和一份UTF-8描述中共占用的字节数都计算在内。
+func trimDesc(desc []rune, n int) []rune {
+	i := len(desc)
+	for ; i > 0 && n > 0; i-- {
+		units := 1
+		if desc[i-1] >= 0x10000 {
+			units = 2
+		}
+		n -= units*4 + utf8.RuneLen(desc[i-1])
+	}
+	return desc[:i]
+}
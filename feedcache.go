@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/mmcdole/gofeed"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+const UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/97.0.4692.71 Safari/537.36"
+
+var errNotModified = errors.New("feed not modified")
+
+// feedValidator 保存feed上次响应的ETag/Last-Modified，用于条件请求。
+type feedValidator struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+// feedCache 以rsshubUrl为key持久化feedValidator，每次更新后写回磁盘。
+type feedCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]feedValidator
+}
+
+var feedValidators *feedCache
+
+func loadFeedCache(path string) *feedCache {
+	c := &feedCache{path: path, entries: map[string]feedValidator{}}
+	d, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Warnf("failed to read feed cache: %s, err: %s", path, err.Error())
+		}
+		return c
+	}
+
+	err = json.Unmarshal(d, &c.entries)
+	if err != nil {
+		log.Warnf("invalid feed cache: %s, err: %s", path, err.Error())
+		c.entries = map[string]feedValidator{}
+	}
+	return c
+}
+
+func (c *feedCache) get(u string) feedValidator {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.entries[u]
+}
+
+func (c *feedCache) set(u string, v feedValidator) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries[u] == v {
+		return
+	}
+	c.entries[u] = v
+
+	d, err := json.MarshalIndent(c.entries, "", "  ")
+	if err != nil {
+		log.Error(err)
+		return
+	}
+
+	err = ioutil.WriteFile(c.path+".tmp", d, 0755)
+	if err == nil {
+		err = os.Rename(c.path+".tmp", c.path)
+	}
+	if err != nil {
+		log.Warnf("failed to save feed cache: %s, err: %s", c.path, err.Error())
+	}
+}
+
+// fetchFeed 带上次的ETag/Last-Modified请求feed，返回304时不解析，直接返回errNotModified。
+func fetchFeed(ctx context.Context, c *http.Client, feedUrl string) (*gofeed.Feed, feedValidator, error) {
+	var v feedValidator
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedUrl, nil)
+	if err != nil {
+		return nil, v, err
+	}
+
+	req.Header.Set("User-Agent", UserAgent)
+	old := feedValidators.get(feedUrl)
+	if old.ETag != "" {
+		req.Header.Set("If-None-Match", old.ETag)
+	}
+	if old.LastModified != "" {
+		req.Header.Set("If-Modified-Since", old.LastModified)
+	}
+
+	res, err := c.Do(req)
+	if err != nil {
+		return nil, v, err
+	}
+	defer func(b io.ReadCloser) {
+		_ = b.Close()
+	}(res.Body)
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, old, errNotModified
+	}
+
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return nil, v, newStatusError(res)
+	}
+
+	feed, err := gofeed.NewParser().Parse(res.Body)
+	if err != nil {
+		return nil, v, err
+	}
+
+	v.ETag = res.Header.Get("ETag")
+	v.LastModified = res.Header.Get("Last-Modified")
+	return feed, v, nil
+}
@@ -2,166 +2,103 @@ package main
 
 import (
 	"fmt"
-	"os"
 )
 
-func NewThirtyFivePhoto(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    fmt.Sprintf("%s%c%s", account.Dir, os.PathSeparator, dateStr),
-		rsshubUrl: fmt.Sprintf("%s/%s", ThirtyFivePhotoUrl, seed),
-		parser:    parseOneTelegramItem,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
+func init() {
+	twitter := &feedSource{
+		parser: parseOneTwitterItem,
+		proxy:  ProxyDefaults{Content: true},
+		urls: func(seed string, account *Account) []string {
+			return []string{
+				fmt.Sprintf("%s/%s/%s", RssHubTwitterUrl, "media", seed),
+				fmt.Sprintf("%s/%s/%s", RssHubTwitterUrl, "user", seed),
+			}
+		},
+		dirTemplate: func(account *Account) string {
+			if account.NoDate {
+				return plainDir
+			}
+			return datedDir
+		},
 	}
-
-	account.ContentUseProxy = true
-	SetHttpClient(u, account)
-	return u
-}
-
-func NewTelegramChannel(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    fmt.Sprintf("%s%c%s", account.Dir, os.PathSeparator, dateStr),
-		rsshubUrl: fmt.Sprintf("%s/%s", RssHubTelegramUrl, seed),
-		parser:    parseOneTelegramItem,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-	}
-
-	account.ContentUseProxy = true
-	SetHttpClient(u, account)
-	return u
-}
-
-func NewWikiDailyPhoto(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    account.Dir,
-		rsshubUrl: "https://zh.wikipedia.org/w/api.php?action=featuredfeed&feed=potd&feedformat=atom",
-		parser:    parseOneWikiPhoto,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-	}
-
-	account.ContentUseProxy = true
-	account.FeedUseProxy = true
-	SetHttpClient(u, account)
-
-	return u
-}
-
-func NewDailyArt(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    account.Dir,
-		rsshubUrl: "https://rsshub.rssforever.com/dailyart/zh",
-		parser:    parseDailyArt,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-	}
-
-	account.ContentUseProxy = true
-	SetHttpClient(u, account)
-	return u
-}
-
-func NewDouyin(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account: seed,
-		folder:  account.Dir,
-		parser:  parseDouyinVideo,
-		noDesc:  account.NoDesc,
-		aType:   account.Type,
-	}
-
-	url := RsshubDouyinUrl
-	if len(account.Url) > 0 {
-		url = account.Url
-	}
-
-	u.rsshubUrl = fmt.Sprintf("%s/%s", url, seed)
-
-	SetHttpClient(u, account)
-
-	return u
+	// 未配置type的账号默认为twitter。
+	RegisterSource("", twitter)
+	RegisterSource(Twitter, twitter)
+
+	RegisterSource(ThirtyFivePhotoRss, &feedSource{
+		parser:      parseOneTelegramItem,
+		proxy:       ProxyDefaults{Content: true},
+		urls:        seedUrls(ThirtyFivePhotoUrl),
+		dirTemplate: fixedDir(datedDir),
+	})
+
+	RegisterSource(TelegramChannelRss, &feedSource{
+		parser:      parseOneTelegramItem,
+		proxy:       ProxyDefaults{Content: true},
+		urls:        seedUrls(RssHubTelegramUrl),
+		dirTemplate: fixedDir(datedDir),
+	})
+
+	RegisterSource(WikiDailyPhotoRSS, &feedSource{
+		parser:      parseOneWikiPhoto,
+		proxy:       ProxyDefaults{Feed: true, Content: true},
+		urls:        fixedUrl("https://zh.wikipedia.org/w/api.php?action=featuredfeed&feed=potd&feedformat=atom"),
+		dirTemplate: fixedDir(plainDir),
+	})
+
+	RegisterSource(DailyArt, &feedSource{
+		parser:      parseDailyArt,
+		proxy:       ProxyDefaults{Content: true},
+		urls:        fixedUrl("https://rsshub.rssforever.com/dailyart/zh"),
+		dirTemplate: fixedDir(plainDir),
+	})
+
+	RegisterSource(Douyin, &feedSource{
+		parser: parseDouyinVideo,
+		urls: func(seed string, account *Account) []string {
+			url := RsshubDouyinUrl
+			if len(account.Url) > 0 {
+				url = account.Url
+			}
+			return []string{fmt.Sprintf("%s/%s", url, seed)}
+		},
+		dirTemplate: fixedDir(plainDir),
+	})
+
+	RegisterSource(CNU, &feedSource{
+		parser:      parseCommonPhoto,
+		urls:        fixedUrl("https://rsshub.rssforever.com/cnu/selected"),
+		dirTemplate: fixedDir(plainDir),
+	})
+
+	RegisterSource(MMFan, &feedSource{
+		parser:      parseCommonPhoto,
+		urls:        fixedUrl("https://rsshub.rssforever.com/95mm/tab/热门"),
+		dirTemplate: fixedDir(plainDir),
+	})
+
+	RegisterSource(WallPaper, &feedSource{
+		parser:      parseCommonPhoto,
+		proxy:       ProxyDefaults{Feed: true, Content: true},
+		urls:        fixedUrl("https://rsshub.app/konachan/post/popular_recent/1w"),
+		dirTemplate: fixedDir(plainDir),
+	})
 }
 
-func SetHttpClient(u *OneUser, account *Account) {
-	u.feedParserClient = clientWithoutProxy
-	u.contentClient = clientWithoutProxy
-	if account.FeedUseProxy {
-		u.feedParserClient = client
-	}
-
-	if account.ContentUseProxy {
-		u.contentClient = client
+func seedUrls(base string) func(seed string, account *Account) []string {
+	return func(seed string, account *Account) []string {
+		return []string{fmt.Sprintf("%s/%s", base, seed)}
 	}
 }
 
-func NewTwitter(seed string, account *Account, mType string) *OneUser {
-	folder := account.Dir
-	if !account.NoDate {
-		folder += fmt.Sprintf("%c/%s", os.PathSeparator, dateStr)
+func fixedUrl(url string) func(seed string, account *Account) []string {
+	return func(seed string, account *Account) []string {
+		return []string{url}
 	}
-
-	u := &OneUser{
-		account:   seed,
-		folder:    folder,
-		rsshubUrl: fmt.Sprintf("%s/%s/%s", RssHubTwitterUrl, mType, seed),
-		parser:    parseOneTwitterItem,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-	}
-
-	account.ContentUseProxy = true
-	SetHttpClient(u, account)
-
-	return u
 }
 
-func NewCNU(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    account.Dir,
-		parser:    parseCommonPhoto,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-		rsshubUrl: "https://rsshub.rssforever.com/cnu/selected",
+func fixedDir(tmpl string) func(account *Account) string {
+	return func(account *Account) string {
+		return tmpl
 	}
-
-	SetHttpClient(u, account)
-
-	return u
-}
-
-func NewMMFan(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    account.Dir,
-		parser:    parseCommonPhoto,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-		rsshubUrl: "https://rsshub.rssforever.com/95mm/tab/热门",
-	}
-
-	SetHttpClient(u, account)
-	return u
-}
-
-func NewWallPaper(seed string, account *Account) *OneUser {
-	u := &OneUser{
-		account:   seed,
-		folder:    account.Dir,
-		parser:    parseCommonPhoto,
-		noDesc:    account.NoDesc,
-		aType:     account.Type,
-		rsshubUrl: "https://rsshub.app/konachan/post/popular_recent/1w",
-	}
-
-	account.ContentUseProxy = true
-	account.FeedUseProxy = true
-	SetHttpClient(u, account)
-	return u
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// MaxFileNameBytes 常见文件系统中文件名的最大字节数。
+	MaxFileNameBytes = 255
+	// 为.tmp后缀和冲突时追加的数字后缀预留的字节数。
+	fileNameReserved = 12
+)
+
+// 各类型账号默认的目录模板。
+const (
+	plainDir = "{dir}"
+	datedDir = "{dir}/{date}"
+)
+
+var (
+	// placeholderReg 匹配{name}或{name:arg}形式的占位符。
+	placeholderReg = regexp.MustCompile(`\{(\w+)(?::([^{}]*))?\}`)
+
+	fileNamePlaceholders = []string{"seed", "date", "published", "title", "guid_hash", "index", "ext"}
+	dirPlaceholders      = []string{"dir", "seed", "type", "date", "published"}
+
+	// claimed 为进行中的下载占用的文件路径，避免两个条目同时写入同一个文件。
+	claimed sync.Map
+)
+
+// expandTemplate 把模板中的占位符替换为value返回的值。
+func expandTemplate(tmpl string, value func(name, arg string) string) string {
+	return placeholderReg.ReplaceAllStringFunc(tmpl, func(m string) string {
+		sm := placeholderReg.FindStringSubmatch(m)
+		return value(sm[1], sm[2])
+	})
+}
+
+// checkTemplate 检查模板中只使用了names中的占位符。
+func checkTemplate(what, tmpl string, names []string) error {
+	for _, m := range placeholderReg.FindAllStringSubmatch(tmpl, -1) {
+		found := false
+		for _, n := range names {
+			if m[1] == n {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("invalid %s: %q, unknown placeholder: %s, supported: %s", what, tmpl, m[0], strings.Join(names, ", "))
+		}
+	}
+	return nil
+}
+
+// formatTime 按arg中的Go时间格式格式化t，未指定时使用20060102。
+func formatTime(t time.Time, arg string) string {
+	if arg == "" {
+		arg = "20060102"
+	}
+	return t.Format(arg)
+}
+
+// sanitizeName 把文件名中路径分隔符、Windows保留字符和控制字符替换为下划线，并去掉首尾的空格和点。
+func sanitizeName(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	return strings.Trim(s, " .")
+}
+
+// truncateName 按字节数截断文件名，保留扩展名，不截断在UTF-8字符中间。
+func truncateName(name string, max int) string {
+	if len(name) <= max {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+	if len(ext) >= max {
+		ext = ""
+	}
+	stem := name[:max-len(ext)]
+	for len(stem) > 0 && !utf8.ValidString(stem) {
+		stem = stem[:len(stem)-1]
+	}
+	return strings.TrimRight(stem, " .") + ext
+}
+
+// renderDir 按目录模板生成photo_dir下的相对目录，模板中的/为目录分隔符，
+// seed与type中的/等字符被替换，{dir}原样使用。
+func renderDir(tmpl string, item *oneItem, acc *Account, seed string) string {
+	dir := expandTemplate(tmpl, func(n, arg string) string {
+		switch n {
+		case "dir":
+			return acc.Dir
+		case "seed":
+			return sanitizeName(seed)
+		case "type":
+			if acc.Type == "" {
+				return Twitter
+			}
+			return sanitizeName(acc.Type)
+		case "date":
+			return formatTime(item.date(), "")
+		case "published":
+			return formatTime(item.date(), arg)
+		}
+		return ""
+	})
+	return filepath.Clean(filepath.FromSlash(dir))
+}
+
+// renderFileName 生成文件名：配置了filename_template时按模板生成，否则使用解析器给出的文件名或<seed>_<md5>.<ext>。
+func renderFileName(tmpl string, item *oneItem, seed, key, ft string) string {
+	ext := strings.TrimPrefix(ft, ".")
+	seed = strings.Replace(seed, "/", "", -1)
+	var name string
+	switch {
+	case tmpl != "":
+		if !strings.Contains(tmpl, "{ext}") {
+			tmpl += ".{ext}"
+		}
+		name = expandTemplate(tmpl, func(n, arg string) string {
+			switch n {
+			case "seed":
+				return seed
+			case "date":
+				return formatTime(item.date(), "")
+			case "published":
+				return formatTime(item.date(), arg)
+			case "title":
+				return item.title
+			case "guid_hash":
+				return key
+			case "index":
+				return fmt.Sprintf("%d", item.index)
+			case "ext":
+				return ext
+			}
+			return ""
+		})
+	case item.fileName != "":
+		name = item.fileName
+	default:
+		name = fmt.Sprintf("%s_%s.%s", seed, key, ext)
+	}
+
+	if sanitizeName(strings.TrimSuffix(name, "."+ext)) == "" {
+		name = fmt.Sprintf("%s.%s", key, ext)
+	}
+	name = sanitizeName(name)
+	return truncateName(name, MaxFileNameBytes-fileNameReserved)
+}
+
+// claimName 为条目key占用文件路径，路径已被其他条目的文件或进行中的下载占用时依次尝试name_1.ext、name_2.ext...
+// 不属于任何条目的已有文件仍按replace_policy处理。
+func claimName(path, key string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i, p := 1, path; ; i++ {
+		if _, loaded := claimed.LoadOrStore(p, key); !loaded {
+			if owner := index.owner(p); owner == "" || owner == key {
+				return p
+			}
+			claimed.Delete(p)
+		}
+		p = fmt.Sprintf("%s_%d%s", base, i, ext)
+	}
+}
+
+// claimFreeName 为条目key占用path_1.ext、path_2.ext...中第一个未被占用、不属于其他条目且不存在的路径。
+func claimFreeName(path, key string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, loaded := claimed.LoadOrStore(p, key); loaded {
+			continue
+		}
+		if owner := index.owner(p); owner == "" || owner == key {
+			if _, err := os.Lstat(p); os.IsNotExist(err) {
+				return p
+			}
+		}
+		claimed.Delete(p)
+	}
+}
+
+func releaseName(path string) {
+	claimed.Delete(path)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestTruncateName(t *testing.T) {
+	cases := []struct {
+		name string
+		in   string
+		max  int
+		want string
+	}{
+		{"short", "a.jpg", 20, "a.jpg"},
+		{"exact", "abcde.jpg", 9, "abcde.jpg"},
+		{"ascii", "abcdefghij.jpg", 9, "abcde.jpg"},
+		{"utf8 boundary", "你好世界.jpg", 12, "你好.jpg"},
+		{"trailing dot", "ab. cd.jpg", 7, "ab.jpg"},
+		{"long ext", "a.abcdefghij", 5, "a.abc"},
+	}
+
+	for _, c := range cases {
+		got := truncateName(c.in, c.max)
+		if got != c.want {
+			t.Errorf("%s: got %q, expect %q", c.name, got, c.want)
+		}
+		if len(got) > c.max || !utf8.ValidString(got) {
+			t.Errorf("%s: invalid result %q", c.name, got)
+		}
+	}
+
+	long := strings.Repeat("中", 200) + ".mp4"
+	got := truncateName(long, MaxFileNameBytes-fileNameReserved)
+	if len(got) > MaxFileNameBytes-fileNameReserved || !strings.HasSuffix(got, ".mp4") || !utf8.ValidString(got) {
+		t.Errorf("got %q", got)
+	}
+}
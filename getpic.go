@@ -1,21 +1,19 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/tls"
 	"encoding/hex"
+	"errors"
 	"fmt"
-	"github.com/dsoprea/go-exif/v3"
-	exifcommon "github.com/dsoprea/go-exif/v3/common"
-	"github.com/dsoprea/go-exif/v3/undefined"
 	jpgs "github.com/dsoprea/go-jpeg-image-structure/v2"
 	pngs "github.com/dsoprea/go-png-image-structure/v2"
 	"github.com/dsoprea/go-utility/v2/image"
 	"github.com/mmcdole/gofeed"
 	log "github.com/sirupsen/logrus"
-	"io/ioutil"
+	"golang.org/x/time/rate"
 	"net/http"
 	"net/url"
 	"os"
@@ -25,32 +23,63 @@ import (
 )
 
 var (
-	config       *Conf
-	rootDir      string
-	libPicDir    string
-	photoDir     string
-	dateStr      string
-	allTaskCount int
+	config    *Conf
+	rootDir   string
+	libPicDir string
+	photoDir  string
+	// 未下载完成的文件，用于断点续传。
+	partialDir string
+	// 被近似图片替代的低分辨率图片。
+	quarantineDir string
+	workers       int
+	inflight      sync.Map
 
 	client, clientWithoutProxy *http.Client
 )
 
 type oneItem struct {
-	url      string
-	desc     string
-	guid     string
-	fileName string
+	url       string
+	desc      string
+	guid      string
+	fileName  string
+	published time.Time
+	// runTime 为任务所在这一轮运行的开始时间，条目没有发布时间时代替发布时间。
+	runTime time.Time
+	// 条目的标题、链接、作者以及从正文中提取的hashtag与mention。
+	title    string
+	link     string
+	postGUID string
+	author   string
+	hashtags []string
+	mentions []string
+	// index 为该文件在所属条目中的序号。
+	index int
+}
+
+// date 返回条目本地时区的发布时间，feed中没有时间时返回本轮运行的时间。
+func (i *oneItem) date() time.Time {
+	if i.published.IsZero() {
+		return i.runTime
+	}
+	return i.published.Local()
 }
 
 type OneUser struct {
 	account          string
-	folder           string
+	dirTemplate      string
 	rsshubUrl        string
 	parser           Parser
 	noDesc           bool
 	feedParserClient *http.Client
 	contentClient    *http.Client
 	aType            string
+	aName            string
+	acc              *Account
+	onDone           func()
+	limiter          *rate.Limiter
+	retry            RetryPolicy
+	// runTime 为生成任务时本轮运行的开始时间。
+	runTime time.Time
 }
 
 func main() {
@@ -63,12 +92,13 @@ func main() {
 		return
 	}
 
+	serveMode := len(os.Args) == 2 && os.Args[1] == "serve"
+
 	customFormatter := &log.TextFormatter{CallerPrettyfier: callerPrettyFieldForLogrus}
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
 	customFormatter.FullTimestamp = true
 	log.SetFormatter(customFormatter)
 	log.SetReportCaller(true)
-	dateStr = time.Now().Format("20060102")
 	var err error
 	config, err = getConf("conf.yaml")
 	if err != nil {
@@ -76,6 +106,12 @@ func main() {
 		return
 	}
 
+	err = checkConf(config)
+	if err != nil {
+		log.Error(err.Error())
+		return
+	}
+
 	rootDir = config.PhotoDir
 	if rootDir == "" {
 		rootDir = DefaultDir
@@ -83,6 +119,32 @@ func main() {
 
 	libPicDir = fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "libpics")
 	photoDir = fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "pics")
+	partialDir = fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "partial")
+	quarantineDir = fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "quarantine")
+	_ = os.MkdirAll(partialDir, os.ModeDir|0755)
+	cleanTmpFiles(photoDir)
+	cleanPartialFiles(partialDir, PartialExpire)
+	index, err = openIndex(fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "index.db"))
+	if err != nil {
+		log.Errorf("failed to open index, err: %s", err.Error())
+		return
+	}
+	defer index.close()
+
+	err = index.migrateLibPics(libPicDir)
+	if err != nil {
+		log.Errorf("failed to import %s, err: %s", libPicDir, err.Error())
+		return
+	}
+
+	err = index.recoverPending()
+	if err != nil {
+		log.Errorf("failed to recover the index, err: %s", err.Error())
+		return
+	}
+
+	feedValidators = loadFeedCache(fmt.Sprintf("%s%c%s", rootDir, os.PathSeparator, "feedcache.json"))
+	setupShutdown(config.ShutdownTimeout)
 
 	client = &http.Client{
 		Timeout: 900 * time.Second,
@@ -111,9 +173,24 @@ func main() {
 		Timeout: 900 * time.Second,
 	}
 
+	limiter := newHostLimiter(config)
+	client.Transport = limiter.wrap(client.Transport)
+	clientWithoutProxy.Transport = limiter.wrap(clientWithoutProxy.Transport)
+
+	maxMemory := config.MaxMemoryMB
+	if maxMemory <= 0 {
+		maxMemory = DefaultMaxMemoryMB
+	}
+	memory = newMemBudget(int64(maxMemory) * 1048576)
+
+	workers = config.Workers
+	if workers <= 0 {
+		workers = DefaultWorkers
+	}
+
 	sg := sync.WaitGroup{}
-	ch := make(chan *OneUser, 40)
-	for i := 0; i < 20; i++ {
+	ch := make(chan *OneUser, workers*2)
+	for i := 0; i < workers; i++ {
 		sg.Add(1)
 		go func() {
 			doOneTask(ch)
@@ -121,30 +198,19 @@ func main() {
 		}()
 	}
 
-	for _, account := range config.Accounts {
-		for _, seed := range account.Seeds {
-			if account.Type == ThirtyFivePhotoRss {
-				addOneTask(ch, NewThirtyFivePhoto(seed, &account))
-			} else if account.Type == TelegramChannelRss {
-				addOneTask(ch, NewTelegramChannel(seed, &account))
-			} else if account.Type == WikiDailyPhotoRSS {
-				addOneTask(ch, NewWikiDailyPhoto(seed, &account))
-			} else if account.Type == DailyArt {
-				addOneTask(ch, NewDailyArt(seed, &account))
-			} else if account.Type == "" {
-				for _, t := range []string{"media", "user"} {
-					addOneTask(ch, NewTwitter(seed, &account, t))
-				}
-			} else if account.Type == Douyin {
-				addOneTask(ch, NewDouyin(seed, &account))
-			} else {
-				switch account.Type {
-				case CNU:
-					addOneTask(ch, NewCNU(seed, &account))
-				case MMFan:
-					addOneTask(ch, NewMMFan(seed, &account))
-				case WallPaper:
-					addOneTask(ch, NewWallPaper(seed, &account))
+	if serveMode {
+		err = serve(ch)
+		if err != nil {
+			log.Error(err.Error())
+		}
+	} else {
+	loop:
+		for i := range config.Accounts {
+			account := &config.Accounts[i]
+			src, _ := getSource(account.Type)
+			for _, o := range src.Tasks(account) {
+				if !addOneTask(ch, o) {
+					break loop
 				}
 			}
 		}
@@ -154,35 +220,47 @@ func main() {
 	sg.Wait()
 }
 
-func addOneTask(ch chan *OneUser, o *OneUser) int {
-	ch <- o
-	allTaskCount++
-	checkAndSleep(allTaskCount)
-	return 1
-}
-
-func checkAndSleep(c int) {
-	if c%20 == 0 {
-		time.Sleep(time.Second)
+// addOneTask 投递一个任务，收到退出信号后不再投递并返回false。
+func addOneTask(ch chan *OneUser, o *OneUser) bool {
+	select {
+	case ch <- o:
+	case <-runCtx.Done():
+		return false
 	}
+	return true
 }
 
 func doOneTask(ch chan *OneUser) {
 	for o := range ch {
-		dealWithOneUrl(o)
+		// 收到退出信号后，队列中尚未开始的任务直接丢弃。
+		if !stopping() {
+			dealWithOneUrl(o)
+		}
+		if o.onDone != nil {
+			o.onDone()
+		}
 	}
 }
 
 func dealWithOneUrl(user *OneUser) {
 	var (
-		feedUrl, seed, dir = user.rsshubUrl, user.account, user.folder
+		feedUrl, seed = user.rsshubUrl, user.account
 	)
+	ctx := withAccountLimiter(abortCtx, user.limiter)
 	s := time.Now()
-	p := gofeed.NewParser()
-	p.Client = user.feedParserClient
-
-	p.UserAgent = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/97.0.4692.71 Safari/537.36"
-	feed, err := p.ParseURL(feedUrl)
+	var (
+		feed      *gofeed.Feed
+		validator feedValidator
+	)
+	err := user.retry.do(fmt.Sprintf("[%s], get feed: %s", seed, feedUrl), func() error {
+		var err error
+		feed, validator, err = fetchFeed(ctx, user.feedParserClient, feedUrl)
+		return err
+	})
+	if err == errNotModified {
+		log.Warnf("[%s], feed not modified, cost %dms", feedUrl, time.Since(s)/time.Millisecond)
+		return
+	}
 	if err != nil {
 		log.Errorf("%s, err: %s", feedUrl, err.Error())
 		return
@@ -197,121 +275,276 @@ func dealWithOneUrl(user *OneUser) {
 		}
 		h := md5.Sum([]byte(guid))
 		fileName := hex.EncodeToString(h[:])
-		hashdir := fmt.Sprintf("%s%c%s%c%s", libPicDir, os.PathSeparator, fileName[:1], os.PathSeparator, fileName[1:2])
-		_ = os.MkdirAll(hashdir, os.ModeDir|0755)
-		libfilePath := fmt.Sprintf("%s%c%s", hashdir, os.PathSeparator, fileName)
 
-		var err error
-		flag, err := isFileExist(libfilePath)
+		r, err := index.get(fileName)
 		if err != nil {
-			log.Warnf("%s, err: %s, file: %s", feedUrl, libfilePath, err.Error())
+			log.Warnf("%s, err: %s, key: %s", feedUrl, err.Error(), fileName)
 			return err
 		}
 
-		if flag {
-			// log.Warnf("the file: account: %s, u: %s was downloaded.", seed, u)
+		if r != nil {
+			// 被video_filter丢弃的视频按当前的规则重新检查，放宽规则后重新下载。
+			if r.Skipped == "" || config.videoFilter(user.acc).check(r.Size, r.video()) != "" {
+				// log.Warnf("the file: account: %s, u: %s was downloaded.", seed, u)
+				return nil
+			}
+			log.Warnf("[%s], video_filter changed, download again: %s, skipped: %s", seed, u, r.Skipped)
+		}
+
+		// twitter的media与user两个feed可能包含同一条推文，避免同时下载到同一个tmp文件。
+		if _, loaded := inflight.LoadOrStore(fileName, struct{}{}); loaded {
 			return nil
 		}
+		defer inflight.Delete(fileName)
+
+		fileDir := fmt.Sprintf("%s%c%s", photoDir, os.PathSeparator, renderDir(user.dirTemplate, item, user.acc, seed))
+		_ = os.MkdirAll(fileDir, os.ModeDir|0755)
 
 		start := time.Now()
-		req, err := http.NewRequest(http.MethodGet, u, nil)
-		if err != nil {
-			log.Warnf("failed to get pic: %s", u)
-			log.Warn(err)
+		partPath := fmt.Sprintf("%s%c%s", partialDir, os.PathSeparator, fileName)
+		var ft string
+		err = user.retry.do(fmt.Sprintf("[%s], get pic: %s", seed, u), func() error {
+			contentType, err := downloadToFile(ctx, user.contentClient, u, partPath)
+			if err != nil {
+				return err
+			}
+
+			// 校验失败的内容不能续传，删除后重新下载。
+			ft, err = validateFile(u, partPath, contentType)
+			if err != nil {
+				removePartial(partPath)
+			}
 			return err
-		}
-		res, err := user.contentClient.Do(req)
+		})
 		if err != nil {
 			log.Warnf("failed to get pic: %s", u)
-			log.Error(err)
+			log.Warn(err)
+			// 可重试的错误保留已下载的部分，下次续传。
+			if ok, _ := retryable(err); !ok && !errors.Is(err, context.Canceled) {
+				removePartial(partPath)
+			}
 			return err
 		}
 
-		if res.StatusCode != 200 {
-			log.Warnf("failed to get pic: %s", u)
-			log.Warnf("some err: %v", res)
-			return nil
+		if item.fileName != "" && user.acc.FilenameTemplate == "" && !strings.HasSuffix(item.fileName, ft) {
+			log.Warnf("[%s], u: %s, file name: %s does not match the content type: %s", seed, u, item.fileName, ft)
 		}
 
-		pic, err := ioutil.ReadAll(res.Body)
+		name := renderFileName(user.acc.FilenameTemplate, item, seed, fileName, ft)
+		dstFilePath := claimName(fmt.Sprintf("%s%c%s", fileDir, os.PathSeparator, name), fileName)
+		defer releaseName(dstFilePath)
+
+		filePath := dstFilePath + ".tmp"
+		err = os.Rename(partPath, filePath)
 		if err != nil {
-			log.Warn(err)
+			log.Error(err)
+			removePartial(partPath)
 			return err
 		}
 
-		pic, err = addDesc(item, user, pic)
+		// 在写入描述信息前计算hash，同一张图片被不同seed转发时描述不同但内容相同。
+		sum, err := fileSha256(filePath)
 		if err != nil {
+			log.Error(err)
+			_ = os.Remove(filePath)
 			return err
 		}
 
-		fileDir := fmt.Sprintf("%s%c%s", photoDir, os.PathSeparator, dir)
-		_ = os.MkdirAll(fileDir, os.ModeDir|0755)
+		action := config.duplicateAction(user.acc)
+		if action != DuplicateKeep {
+			first, err := index.findHash(sum)
+			if err != nil {
+				log.Error(err)
+				_ = os.Remove(filePath)
+				return err
+			}
 
-		var filePath string
-		if item.fileName != "" {
-			filePath = fmt.Sprintf("%s%c%s.tmp", fileDir, os.PathSeparator, item.fileName)
-		} else {
-			filePath = fmt.Sprintf("%s%c%s%s.tmp", fileDir, os.PathSeparator,
-				strings.Replace(seed, "/", "", -1)+"_"+fileName, getFileType(pic))
+			if first != nil && first.Key != fileName && first.Path != "" && first.DuplicateOf == "" {
+				if _, err := os.Stat(first.Path); err == nil {
+					_ = os.Remove(filePath)
+					path, err := linkDuplicate(action, first.Path, dstFilePath)
+					if err != nil {
+						log.Warnf("failed to %s %s to %s, err: %s", action, first.Path, dstFilePath, err.Error())
+						return err
+					}
+
+					log.Warnf("duplicate account: %s, u: %s, same as: %s, action: %s, file: %s", seed, u, first.Path, action, path)
+					return index.put(&Record{
+						Key:         fileName,
+						GUID:        guid,
+						URL:         u,
+						Account:     user.aName,
+						Seed:        seed,
+						Path:        path,
+						Size:        first.Size,
+						SHA256:      sum,
+						DuplicateOf: first.Key,
+					})
+				}
+			}
 		}
 
-		f, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE, 0755)
-		if err != nil {
-			log.Error(err)
-			return err
+		// 近似图片中保留分辨率更高的一张，新图片分辨率不高于已有图片时直接丢弃或隔离。
+		var (
+			phash   string
+			similar *Record
+		)
+		ic, icErr := imageConfig(filePath)
+		if icErr == nil && config.PHashThreshold > 0 {
+			ph, err := imageDHash(filePath, ic)
+			if err != nil {
+				log.Warnf("failed to compute phash: %s, err: %s", filePath, err.Error())
+			} else {
+				phash = formatPHash(ph)
+				similar, err = index.findSimilar(ph, config.PHashThreshold, fileName)
+				if err != nil {
+					log.Error(err)
+					_ = os.Remove(filePath)
+					return err
+				}
+			}
 		}
-		w := bufio.NewWriter(f)
-		n, err := w.Write(pic)
 
-		if err != nil || n != len(pic) {
-			log.Error(err)
-			_ = os.Remove(filePath)
-			return err
+		if similar != nil && similar.Width*similar.Height >= ic.Width*ic.Height {
+			var size int64
+			if st, err := os.Stat(filePath); err == nil {
+				size = st.Size()
+			}
+			action := config.nearDuplicateAction()
+			path, err := discardNearDuplicate(action, filePath)
+			if err != nil {
+				log.Error(err)
+				_ = os.Remove(filePath)
+				return err
+			}
+
+			log.Warnf("near duplicate account: %s, u: %s, %dx%d, kept: %s, %dx%d, action: %s",
+				seed, u, ic.Width, ic.Height, similar.Path, similar.Width, similar.Height, action)
+			return index.put(&Record{
+				Key:         fileName,
+				GUID:        guid,
+				URL:         u,
+				Account:     user.aName,
+				Seed:        seed,
+				Path:        path,
+				Size:        size,
+				SHA256:      sum,
+				DuplicateOf: similar.Key,
+				PHash:       phash,
+				Width:       ic.Width,
+				Height:      ic.Height,
+			})
 		}
-		_ = w.Flush()
-		_ = f.Close()
 
-		_, err = os.OpenFile(libfilePath, os.O_RDWR|os.O_CREATE, 0755)
+		err = addDescToFile(item, user, filePath, ft)
 		if err != nil {
 			log.Error(err)
 			_ = os.Remove(filePath)
 			return err
 		}
 
+		// 文件时间设置为条目的发布时间，补下载的旧条目不会显示为今天的文件。
+		mtime := item.date()
+		err = os.Chtimes(filePath, mtime, mtime)
+		if err != nil {
+			log.Warnf("failed to set file time: %s, err: %s", filePath, err.Error())
+		}
+
 		// 转正文件。
 		fstat, err := os.Stat(filePath)
 		if err != nil {
 			return err
 		}
-		dstFilePath := strings.TrimRight(filePath, ".tmp")
-		fdstat, err := os.Stat(dstFilePath)
-		if err == nil {
-			// 同名文件的size比新文件小，则覆盖，否则保留
-			if fdstat.Size() < fstat.Size() {
-				_ = os.Remove(dstFilePath)
-				_ = os.Rename(filePath, dstFilePath)
+
+		rec := &Record{
+			Key:     fileName,
+			GUID:    guid,
+			URL:     u,
+			Account: user.aName,
+			Seed:    seed,
+			Path:    dstFilePath,
+			Size:    fstat.Size(),
+			SHA256:  sum,
+			PHash:   phash,
+			Width:   ic.Width,
+			Height:  ic.Height,
+		}
+
+		// 按video_filter丢弃不满足条件的视频，记录大小、分辨率和时长，规则变化时不用重新下载即可重新检查。
+		if hasMp4Meta(ft) {
+			video, err := inspectMp4(filePath)
+			if err != nil {
+				log.Warnf("failed to inspect video: %s, err: %s", filePath, err.Error())
+				video = nil
 			} else {
+				rec.Width, rec.Height = video.Width, video.Height
+				rec.Duration, rec.Codec = video.Duration.Seconds(), video.Codec
+			}
+
+			if reason := config.videoFilter(user.acc).check(fstat.Size(), video); reason != "" {
 				_ = os.Remove(filePath)
+				rec.Path = ""
+				rec.Skipped = reason
+				log.Warnf("skip account: %s, u: %s, reason: %s", seed, u, rec.Skipped)
+				return index.put(rec)
 			}
-		} else {
-			// 新文件则直接转正。
-			if os.IsNotExist(err) {
-				// 丢弃小于8MB的MP4文件。
-				if strings.HasSuffix(filePath, ".mp4.tmp") && fstat.Size() < 1048576*8 {
-					_ = os.Remove(filePath)
-				} else {
-					_ = os.Rename(filePath, dstFilePath)
-				}
-			} else {
-				log.Warnf("some error: %s", err.Error())
+		}
+
+		// 同名文件已存在时按replace_policy决定覆盖、保留旧文件或两者都保留。
+		target := dstFilePath
+		_, err = os.Stat(dstFilePath)
+		if err == nil {
+			target = sameNameTarget(config.replacePolicy(user.acc), filePath, dstFilePath, fileName)
+			if target != "" && target != dstFilePath {
+				defer releaseName(target)
+			}
+		} else if !os.IsNotExist(err) {
+			log.Warnf("some error: %s", err.Error())
+			_ = os.Remove(filePath)
+			return err
+		}
+
+		// 保留已有文件时记录指向已有文件，新文件的hash已不存在，不能作为查找重复和近似图片的对象。
+		if target == "" {
+			_ = os.Remove(filePath)
+			rec.SHA256, rec.PHash = "", ""
+			rec.Size, rec.Width, rec.Height = 0, 0, 0
+			if st, err := os.Stat(dstFilePath); err == nil {
+				rec.Size = st.Size()
+			}
+			return index.put(rec)
+		}
+
+		var sidecars []sidecar
+		if user.acc.Xmp == XmpSidecar || (user.acc.Xmp == XmpEmbed && !hasDescSupport(ft)) {
+			sidecars = append(sidecars, sidecar{ext: ".xmp", data: buildXmp(item, user)})
+		}
+		if user.acc.JsonSidecar {
+			d, err := buildItemMeta(item, feedUrl, guid, seed)
+			if err != nil {
+				log.Error(err)
+				_ = os.Remove(filePath)
 				return err
 			}
+			sidecars = append(sidecars, sidecar{ext: ".json", data: d})
+		}
+
+		err = commitFile(rec, filePath, target, sidecars)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		dstFilePath = target
+
+		if similar != nil {
+			replaceNearDuplicate(similar, fileName, ic)
 		}
 
 		log.Warnf("done one account: %s, u: %s, file: %s, cost: %dms", seed, u, dstFilePath, time.Since(start)/time.Millisecond)
 		return nil
 	}
 
+	failed := false
 	if len(feed.Items) > 0 {
 		for _, i := range feed.Items {
 			items := user.parser(i, seed)
@@ -319,28 +552,46 @@ func dealWithOneUrl(user *OneUser) {
 				continue
 			}
 			for sn, j := range items {
+				if stopping() {
+					log.Warnf("[%s], stop before finishing the feed: %s", seed, feedUrl)
+					return
+				}
 				if user.aType == TelegramChannelRss {
 					j.guid = fmt.Sprintf("%s-%d", i.GUID, sn)
 				}
+				j.index = sn
+				j.published = publishedTime(i)
+				j.runTime = user.runTime
+				describe(j, i, config.descMode(user.acc))
 				err = getOne(j)
 				if err != nil {
+					// 404、410等永久失败的条目下次也不会成功，不影响记录ETag/Last-Modified。
+					if !permanentFailure(err) {
+						failed = true
+					}
 					log.Warnf("some error: %s, picUrl: %s, desc: %s", seed, j.url, i.Description)
 				}
 			}
 		}
 	}
 
+	// 除永久失败外全部条目处理成功后才记录ETag/Last-Modified，否则下次feed未变化时失败的条目将不再重试。
+	if !failed {
+		feedValidators.set(feedUrl, validator)
+	}
+
 	log.Warnf("[%s], done one round costs: %dms", seed, time.Since(s)/time.Millisecond)
 }
 
-func addDesc(item *oneItem, user *OneUser, pic []byte) ([]byte, error) {
+// addDesc 按文件类型写入描述信息，不支持的类型原样返回。
+func addDesc(item *oneItem, user *OneUser, pic []byte, ft string) ([]byte, error) {
 	if user.noDesc {
 		return pic, nil
 	}
 
-	ft := getFileType(pic)
 	var p riimage.MediaParser
-	if ft == ".jpg" {
+	switch ft {
+	case ".jpg":
 		p = jpgs.NewJpegMediaParser()
 		intfc, err := p.ParseBytes(pic)
 		if err != nil {
@@ -349,14 +600,7 @@ func addDesc(item *oneItem, user *OneUser, pic []byte) ([]byte, error) {
 		}
 
 		sl := intfc.(*jpgs.SegmentList)
-		rootIb, _ := sl.ConstructExifBuilder()
-		rootIb, err = addExif(item, rootIb)
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
-
-		err = sl.SetExif(rootIb)
+		err = setJpegExif(sl, item, user)
 		if err != nil {
 			log.Error(err)
 			return nil, err
@@ -369,7 +613,7 @@ func addDesc(item *oneItem, user *OneUser, pic []byte) ([]byte, error) {
 			return nil, err
 		}
 		pic = b.Bytes()
-	} else {
+	case ".png":
 		p = pngs.NewPngMediaParser()
 		intfc, err := p.ParseBytes(pic)
 		if err != nil {
@@ -379,7 +623,7 @@ func addDesc(item *oneItem, user *OneUser, pic []byte) ([]byte, error) {
 
 		cl := intfc.(*pngs.ChunkSlice)
 		rootIb, _ := cl.ConstructExifBuilder()
-		rootIb, err = addExif(item, rootIb)
+		rootIb, err = addExif(item, user, rootIb, exifByteOrder(cl.Exif()))
 		if err != nil {
 			log.Error(err)
 			return nil, err
@@ -400,65 +644,3 @@ func addDesc(item *oneItem, user *OneUser, pic []byte) ([]byte, error) {
 	}
 	return pic, nil
 }
-
-func addExif(item *oneItem, rootIb *exif.IfdBuilder) (*exif.IfdBuilder, error) {
-	if rootIb == nil {
-		im, err := exifcommon.NewIfdMappingWithStandard()
-		if err != nil {
-			log.Error(err)
-			return nil, err
-		}
-		ti := exif.NewTagIndex()
-		rootIb = exif.NewIfdBuilder(im, ti, exifcommon.IfdStandardIfdIdentity, exifcommon.EncodeDefaultByteOrder)
-	}
-
-	exifIb, err := exif.GetOrCreateIbFromRootIb(rootIb, "IFD/Exif")
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-	uc := exifundefined.Tag9286UserComment{
-		EncodingType:  exifundefined.TagUndefinedType_9286_UserComment_Encoding_ASCII,
-		EncodingBytes: []byte(item.desc),
-	}
-	err = exifIb.SetStandardWithName("UserComment", uc)
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-
-	exifIb, err = exif.GetOrCreateIbFromRootIb(rootIb, "IFD")
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-	err = exifIb.SetStandardWithName("Make", "None")
-	if err != nil {
-		log.Error(err)
-		return nil, err
-	}
-	return rootIb, nil
-}
-
-func isFileExist(filePath string) (bool, error) {
-	_, err := os.Stat(filePath)
-	if err == nil {
-		return true, nil
-	}
-
-	if os.IsExist(err) {
-		return true, nil
-	} else if os.IsNotExist(err) {
-		return false, nil
-	}
-	return false, err
-}
-
-func getFileType(content []byte) string {
-	// png 89 50 4E 47 0D 0A 1A 0A
-	if bytes.HasPrefix(content, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}) {
-		return ".png"
-	}
-
-	return ".jpg"
-}
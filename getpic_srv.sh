@@ -39,7 +39,13 @@ startup() {
 stopnow() {
     running
     if [ $? -eq 0 ]; then
-        kill -9 ${pid}
+        # 先发送SIGTERM等待进行中的下载收尾，超时后再强制结束。
+        kill "${pid}"
+        for _ in $(seq 1 60); do
+            running || break
+            sleep 1
+        done
+        running && kill -9 "${pid}"
         # shellcheck disable=SC2091
         $(rm -f "${pidfile}" >/dev/null 2>&1)
         echo "stopped: ${servicename}"
@@ -1,8 +1,3 @@
 #!/bin/bash
 
-while : 
-do
-	./getpic >>run.log 2>&1
-	sleep 300
-done
-
+exec ./getpic serve >>run.log 2>&1
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var (
+	itemsBucket  = []byte("items")
+	metaBucket   = []byte("meta")
+	hashesBucket = []byte("hashes")
+	// phashesBucket 以Key为key保存图片的感知hash，用于查找近似图片。
+	phashesBucket = []byte("phashes")
+	// pathsBucket 记录文件路径属于哪个条目，用于区分文件名冲突与同一条目的重新下载。
+	pathsBucket = []byte("paths")
+
+	libPicsMigratedKey = []byte("libpics_migrated")
+	libPicNameReg      = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Record 是一条已下载条目的记录，Key为md5(guid)，与原libpics中的文件名一致。
+type Record struct {
+	Key     string `json:"key"`
+	GUID    string `json:"guid,omitempty"`
+	URL     string `json:"url,omitempty"`
+	Account string `json:"account,omitempty"`
+	Seed    string `json:"seed,omitempty"`
+	Path    string `json:"path,omitempty"`
+	Size    int64  `json:"size,omitempty"`
+	// SHA256 为下载内容写入描述信息之前的hash。
+	SHA256  string    `json:"sha256,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// DuplicateOf 为内容相同或近似的条目的Key。
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// 图片的感知hash，图片或视频的分辨率。
+	PHash  string `json:"phash,omitempty"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+	// 视频的时长（秒）与编码。
+	Duration float64 `json:"duration,omitempty"`
+	Codec    string  `json:"codec,omitempty"`
+	// Migrated 表示记录由libpics导入，只有Key和时间。
+	Migrated bool `json:"migrated,omitempty"`
+	// Pending 表示文件正在转正，尚未确认落盘。
+	Pending bool `json:"pending,omitempty"`
+	// Skipped 为条目被规则丢弃的原因，此时不保存文件，规则放宽后会重新下载。
+	Skipped string `json:"skipped,omitempty"`
+}
+
+// original 表示记录对应一个已保存的独立文件，可作为查找重复和近似图片的对象。
+func (r *Record) original() bool {
+	return r.DuplicateOf == "" && !r.Pending && r.Skipped == ""
+}
+
+// downloadIndex 基于bbolt的下载索引，替代libpics中的空文件标记。
+type downloadIndex struct {
+	db *bolt.DB
+}
+
+var index *downloadIndex
+
+func openIndex(path string) (*downloadIndex, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{itemsBucket, metaBucket, hashesBucket, phashesBucket, pathsBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &downloadIndex{db: db}, nil
+}
+
+func (i *downloadIndex) close() {
+	_ = i.db.Close()
+}
+
+// get 查找记录，不存在时返回nil。
+func (i *downloadIndex) get(key string) (*Record, error) {
+	var r *Record
+	err := i.db.View(func(tx *bolt.Tx) error {
+		d := tx.Bucket(itemsBucket).Get([]byte(key))
+		if d == nil {
+			return nil
+		}
+		r = &Record{}
+		return json.Unmarshal(d, r)
+	})
+	return r, err
+}
+
+func (i *downloadIndex) put(r *Record) error {
+	now := time.Now()
+	if r.Created.IsZero() {
+		r.Created = now
+	}
+	r.Updated = now
+
+	d, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	return i.db.Update(func(tx *bolt.Tx) error {
+		// 已有的hash映射指向的文件被删除或不再是独立文件时，改为指向新条目，后续的重复文件以新条目为准。
+		if r.SHA256 != "" && r.original() {
+			hb := tx.Bucket(hashesBucket)
+			if cur := hb.Get([]byte(r.SHA256)); cur == nil || !hashOwner(tx, string(cur)) {
+				if err := hb.Put([]byte(r.SHA256), []byte(r.Key)); err != nil {
+					return err
+				}
+			}
+		}
+
+		pb := tx.Bucket(phashesBucket)
+		if h, ok := parsePHash(r.PHash); ok && r.original() {
+			if err := pb.Put([]byte(r.Key), phashBytes(h)); err != nil {
+				return err
+			}
+		} else if err := pb.Delete([]byte(r.Key)); err != nil {
+			return err
+		}
+
+		// 路径已属于其他仍使用该路径的条目时保持不变，例如skip时记录指向首个条目的文件。
+		if r.Path != "" {
+			if cur := tx.Bucket(pathsBucket).Get([]byte(r.Path)); cur == nil || pathOwner(tx, r.Path, string(cur)) == "" {
+				if err := tx.Bucket(pathsBucket).Put([]byte(r.Path), []byte(r.Key)); err != nil {
+					return err
+				}
+			}
+		}
+
+		return tx.Bucket(itemsBucket).Put([]byte(r.Key), d)
+	})
+}
+
+// hashOwner 检查key对应的记录是否仍是文件存在的独立文件，可以作为重复和近似图片的比较对象。
+func hashOwner(tx *bolt.Tx, key string) bool {
+	d := tx.Bucket(itemsBucket).Get([]byte(key))
+	if d == nil {
+		return false
+	}
+
+	r := &Record{}
+	if json.Unmarshal(d, r) != nil || !r.original() || r.Path == "" {
+		return false
+	}
+	_, err := os.Stat(r.Path)
+	return err == nil
+}
+
+// pathOwner 检查key对应的记录是否仍使用path，是则返回key，否则返回空。
+func pathOwner(tx *bolt.Tx, path, key string) string {
+	d := tx.Bucket(itemsBucket).Get([]byte(key))
+	if d == nil {
+		return ""
+	}
+
+	r := &Record{}
+	if json.Unmarshal(d, r) != nil || r.Path != path {
+		return ""
+	}
+	return key
+}
+
+// owner 返回文件路径所属条目的Key，不属于任何条目时返回空。
+func (i *downloadIndex) owner(path string) string {
+	var key string
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		if k := tx.Bucket(pathsBucket).Get([]byte(path)); k != nil {
+			key = pathOwner(tx, path, string(k))
+		}
+		return nil
+	})
+	return key
+}
+
+func (i *downloadIndex) delete(key string) error {
+	return i.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(phashesBucket).Delete([]byte(key)); err != nil {
+			return err
+		}
+		return tx.Bucket(itemsBucket).Delete([]byte(key))
+	})
+}
+
+// findSimilar 查找感知hash汉明距离不超过threshold的最相近的条目，不存在时返回nil。
+// 文件已被删除或不再是独立文件的条目不参与比较，并删除其感知hash。
+func (i *downloadIndex) findSimilar(h uint64, threshold int, exclude string) (*Record, error) {
+	var key string
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		pb := tx.Bucket(phashesBucket)
+		removed := 0
+		for {
+			best := threshold + 1
+			key = ""
+			_ = pb.ForEach(func(k, v []byte) error {
+				if len(v) != 8 || string(k) == exclude {
+					return nil
+				}
+				if d := hamming(h, binary.BigEndian.Uint64(v)); d < best {
+					key, best = string(k), d
+				}
+				return nil
+			})
+			if key == "" || hashOwner(tx, key) {
+				break
+			}
+
+			// ForEach中不能修改bucket，删除后重新查找。
+			removed++
+			if err := pb.Delete([]byte(key)); err != nil {
+				return err
+			}
+		}
+		if removed > 0 {
+			log.Warnf("removed %d phashes of missing files", removed)
+		}
+		return nil
+	})
+	if err != nil || key == "" {
+		return nil, err
+	}
+	return i.get(key)
+}
+
+// findHash 查找内容hash相同的首个条目，不存在时返回nil。
+func (i *downloadIndex) findHash(sum string) (*Record, error) {
+	var key []byte
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		if k := tx.Bucket(hashesBucket).Get([]byte(sum)); k != nil {
+			key = append(key, k...)
+		}
+		return nil
+	})
+	if key == nil {
+		return nil, nil
+	}
+	return i.get(string(key))
+}
+
+// migrateLibPics 把旧的libpics/<h0>/<h1>/<md5(guid)>标记文件一次性导入索引，导入后不再重复执行。
+func (i *downloadIndex) migrateLibPics(dir string) error {
+	var done bool
+	_ = i.db.View(func(tx *bolt.Tx) error {
+		done = tx.Bucket(metaBucket).Get(libPicsMigratedKey) != nil
+		return nil
+	})
+	if done {
+		return nil
+	}
+
+	count := 0
+	err := i.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(itemsBucket)
+		err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if info.IsDir() || !libPicNameReg.MatchString(info.Name()) || b.Get([]byte(info.Name())) != nil {
+				return nil
+			}
+
+			d, err := json.Marshal(&Record{
+				Key:      info.Name(),
+				Created:  info.ModTime(),
+				Updated:  info.ModTime(),
+				Migrated: true,
+			})
+			if err != nil {
+				return err
+			}
+			count++
+			return b.Put([]byte(info.Name()), d)
+		})
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(metaBucket).Put(libPicsMigratedKey, []byte(time.Now().Format(time.RFC3339)))
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Warnf("imported %d records from %s", count, dir)
+	return nil
+}
+
+// recoverPending 修复上次崩溃时留下的Pending记录：文件已转正的标记为完成，否则删除记录以便重新下载。
+func (i *downloadIndex) recoverPending() error {
+	var pending []*Record
+	err := i.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(itemsBucket).ForEach(func(k, v []byte) error {
+			r := &Record{}
+			if err := json.Unmarshal(v, r); err != nil || !r.Pending {
+				return nil
+			}
+			pending = append(pending, r)
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range pending {
+		st, err := os.Stat(r.Path)
+		if err == nil && st.Size() == r.Size {
+			r.Pending = false
+			err = i.put(r)
+			log.Warnf("recovered record: %s, file: %s", r.Key, r.Path)
+		} else {
+			err = i.delete(r.Key)
+			log.Warnf("dropped unfinished record: %s, file: %s", r.Key, r.Path)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func fileSha256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mime"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const htmlType = ".html"
+
+// genericExtReg 匹配可以直接使用的url中的扩展名。
+var genericExtReg = regexp.MustCompile(`^\.[a-z0-9]{1,5}$`)
+
+// mimeTypes 为各扩展名对应的Content-Type。
+var mimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".heic": "image/heic",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+	".webm": "video/webm",
+	".mkv":  "video/x-matroska",
+}
+
+// getFileType 根据文件头的magic bytes判断文件类型，返回扩展名，无法识别时返回空。
+func getFileType(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte{0xFF, 0xD8, 0xFF}):
+		return ".jpg"
+	// png 89 50 4E 47 0D 0A 1A 0A
+	case bytes.HasPrefix(content, []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}):
+		return ".png"
+	case bytes.HasPrefix(content, []byte("GIF87a")), bytes.HasPrefix(content, []byte("GIF89a")):
+		return ".gif"
+	case len(content) >= 12 && bytes.Equal(content[:4], []byte("RIFF")) && bytes.Equal(content[8:12], []byte("WEBP")):
+		return ".webp"
+	case len(content) >= 12 && bytes.Equal(content[4:8], []byte("ftyp")):
+		return isoBmffType(content)
+	case bytes.HasPrefix(content, []byte{0x1A, 0x45, 0xDF, 0xA3}):
+		// EBML头中的DocType区分webm和mkv。
+		if bytes.Contains(content, []byte("webm")) {
+			return ".webm"
+		}
+		return ".mkv"
+	case isHtml(content):
+		return htmlType
+	}
+
+	return ""
+}
+
+// isoBmffType 根据ftyp box中的major brand和compatible brands区分AVIF、HEIC、MOV和MP4。
+func isoBmffType(content []byte) string {
+	size := int(content[0])<<24 | int(content[1])<<16 | int(content[2])<<8 | int(content[3])
+	if size < 16 || size > len(content) {
+		size = len(content)
+	}
+
+	brands := []string{string(content[8:12])}
+	for i := 16; i+4 <= size; i += 4 {
+		brands = append(brands, string(content[i:i+4]))
+	}
+
+	has := func(names ...string) bool {
+		for _, b := range brands {
+			for _, n := range names {
+				if b == n {
+					return true
+				}
+			}
+		}
+		return false
+	}
+
+	switch {
+	case has("avif", "avis"):
+		return ".avif"
+	case has("heic", "heix", "hevc", "hevx", "heim", "heis", "mif1", "msf1"):
+		return ".heic"
+	case brands[0] == "qt  ":
+		return ".mov"
+	}
+	return ".mp4"
+}
+
+func isHtml(content []byte) bool {
+	c := bytes.TrimLeft(bytes.TrimPrefix(content, []byte{0xEF, 0xBB, 0xBF}), " \t\r\n")
+	c = bytes.ToLower(c)
+	for _, p := range []string{"<!doctype html", "<html", "<head", "<body", "<script", "<title"} {
+		if bytes.HasPrefix(c, []byte(p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// typeFromContentType 根据Content-Type推断扩展名，用于文件头无法识别的情况。
+func typeFromContentType(ct string) string {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return ""
+	}
+
+	if mt == "text/html" {
+		return htmlType
+	}
+
+	for ext, t := range mimeTypes {
+		if t == mt {
+			return ext
+		}
+	}
+	return ""
+}
+
+// checkMediaType 结合文件头与Content-Type确定最终的文件类型，HTML页面返回错误；
+// 文件头无法识别时，只有Content-Type为image/*、video/*或application/octet-stream的内容
+// 按Content-Type或url中的扩展名保存，例如BMP、TIFF，其他如JSON、纯文本的错误信息返回错误。
+func checkMediaType(sniffed, ct, u string) (string, error) {
+	declared := typeFromContentType(ct)
+	if sniffed == htmlType || (sniffed == "" && declared == htmlType) {
+		return "", fmt.Errorf("got html page instead of media, content-type: %q", ct)
+	}
+
+	if sniffed == "" {
+		if declared == "" {
+			if !isGenericMedia(ct) {
+				return "", fmt.Errorf("unknown media type, content-type: %q", ct)
+			}
+			declared = genericType(ct, u)
+			log.Warnf("unknown media type: %s, content-type: %q, save as %s", u, ct, declared)
+		}
+		return declared, nil
+	}
+
+	if declared != "" && declared != sniffed {
+		log.Warnf("content-type %q does not match the content, detected: %s", ct, sniffed)
+	}
+	return sniffed, nil
+}
+
+// isGenericMedia 返回无法识别的内容的Content-Type是否表明其为媒体文件。
+func isGenericMedia(ct string) bool {
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "video/") || mt == "application/octet-stream"
+}
+
+// genericType 返回无法识别的文件使用的扩展名：优先使用Content-Type对应的扩展名，其次是url中的扩展名，都没有时为.bin。
+func genericType(ct, u string) string {
+	if mt, _, err := mime.ParseMediaType(ct); err == nil && mt != "application/octet-stream" {
+		if exts, _ := mime.ExtensionsByType(mt); len(exts) > 0 {
+			return exts[0]
+		}
+	}
+
+	if pu, err := url.Parse(u); err == nil {
+		ext := strings.ToLower(path.Ext(pu.Path))
+		if genericExtReg.MatchString(ext) {
+			return ext
+		}
+	}
+	return ".bin"
+}
+
+// hasDescSupport 返回该类型是否支持写入描述信息。
+func hasDescSupport(ft string) bool {
+	return ft == ".jpg" || ft == ".png"
+}
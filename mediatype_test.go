@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestGetFileType(t *testing.T) {
+	ftyp := func(brands string) []byte {
+		b := append(u32(uint32(8+len(brands))), "ftyp"...)
+		return append(b, brands...)
+	}
+
+	cases := []struct {
+		name    string
+		content []byte
+		want    string
+	}{
+		{"jpeg", []byte{0xFF, 0xD8, 0xFF, 0xE0, 0, 0x10}, ".jpg"},
+		{"png", []byte{0x89, 'P', 'N', 'G', 0x0D, 0x0A, 0x1A, 0x0A, 0}, ".png"},
+		{"gif", []byte("GIF89a\x01\x00"), ".gif"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), ".webp"},
+		{"avif", ftyp("avif\x00\x00\x00\x00mif1miaf"), ".avif"},
+		{"heic", ftyp("heic\x00\x00\x00\x00mif1heic"), ".heic"},
+		{"mov", ftyp("qt  \x00\x00\x02\x00qt  "), ".mov"},
+		{"mp4", ftyp("isom\x00\x00\x02\x00isomiso2mp41"), ".mp4"},
+		{"webm", []byte("\x1A\x45\xDF\xA3\x9f\x42\x82\x84webm"), ".webm"},
+		{"mkv", []byte("\x1A\x45\xDF\xA3\x9f\x42\x82\x88matroska"), ".mkv"},
+		{"html", []byte("\xEF\xBB\xBF\r\n  <!DOCTYPE html><html>"), htmlType},
+		{"html without doctype", []byte("<HTML><body>404</body>"), htmlType},
+		{"unknown", []byte("BM\x00\x00\x00\x00"), ""},
+		{"empty", nil, ""},
+	}
+
+	for _, c := range cases {
+		if got := getFileType(c.content); got != c.want {
+			t.Errorf("%s: got %q, expect %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestCheckMediaType(t *testing.T) {
+	cases := []struct {
+		sniffed, ct, u string
+		want           string
+		ok             bool
+	}{
+		{".jpg", "image/png", "http://a/x", ".jpg", true},
+		{"", "image/png", "http://a/x", ".png", true},
+		{"", "application/octet-stream", "http://a/x.BMP?s=1", ".bmp", true},
+		{"", "application/octet-stream", "http://a/x", ".bin", true},
+		{"", "video/x-unknown", "http://a/x.flv", ".flv", true},
+		{htmlType, "image/jpeg", "http://a/x.jpg", "", false},
+		{"", "text/html; charset=utf-8", "http://a/x.jpg", "", false},
+		{"", "application/json", "http://a/x.jpg", "", false},
+		{"", "text/plain", "http://a/x.jpg", "", false},
+		{"", "application/xml", "http://a/x.jpg", "", false},
+		{"", "", "http://a/x.jpg", "", false},
+	}
+
+	for _, c := range cases {
+		got, err := checkMediaType(c.sniffed, c.ct, c.u)
+		if got != c.want || (err == nil) != c.ok {
+			t.Errorf("%q %q %q: got %q %v, expect %q", c.sniffed, c.ct, c.u, got, err, c.want)
+		}
+	}
+}
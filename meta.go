@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// itemMeta 是json sidecar的内容，记录文件与来源条目的对应关系。
+type itemMeta struct {
+	Feed       string     `json:"feed"`
+	Link       string     `json:"link,omitempty"`
+	GUID       string     `json:"guid"`
+	Title      string     `json:"title,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Published  *time.Time `json:"published,omitempty"`
+	Hashtags   []string   `json:"hashtags,omitempty"`
+	Mentions   []string   `json:"mentions,omitempty"`
+	MediaURL   string     `json:"media_url"`
+	Index      int        `json:"index"`
+	Downloaded time.Time  `json:"downloaded"`
+}
+
+// buildItemMeta 生成json sidecar，guid为文件所属条目的guid，feed中没有作者时使用种子名。
+func buildItemMeta(item *oneItem, feedUrl, guid, seed string) ([]byte, error) {
+	m := &itemMeta{
+		Feed:       feedUrl,
+		Link:       item.link,
+		GUID:       item.postGUID,
+		Title:      item.title,
+		Author:     item.author,
+		Hashtags:   item.hashtags,
+		Mentions:   item.mentions,
+		MediaURL:   item.url,
+		Index:      item.index,
+		Downloaded: time.Now(),
+	}
+	if m.GUID == "" {
+		m.GUID = guid
+	}
+	if m.Author == "" {
+		m.Author = seed
+	}
+	if !item.published.IsZero() {
+		m.Published = &item.published
+	}
+	return json.MarshalIndent(m, "", "  ")
+}
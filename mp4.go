@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// mp4Box 为ISO-BMFF中的一个box，start和end为box在所属范围中的偏移，hdr为box头的长度。
+type mp4Box struct {
+	typ   string
+	start int64
+	hdr   int64
+	end   int64
+}
+
+// mp4Tag 为写入moov/udta/meta/ilst中的一项元数据，key为©cmt等4字节的atom类型。
+type mp4Tag struct {
+	key   string
+	value string
+}
+
+// hasMp4Meta 返回该类型是否可以写入udta/ilst元数据。
+func hasMp4Meta(ft string) bool {
+	return ft == ".mp4" || ft == ".mov"
+}
+
+// readBoxes 解析r中[start, end)范围内连续的box。
+func readBoxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	h := make([]byte, 16)
+	for pos := start; pos+8 <= end; {
+		if _, err := r.ReadAt(h[:8], pos); err != nil {
+			return nil, err
+		}
+
+		size, hdr := int64(binary.BigEndian.Uint32(h)), int64(8)
+		switch size {
+		case 1:
+			if _, err := r.ReadAt(h[8:16], pos+8); err != nil {
+				return nil, err
+			}
+			size, hdr = int64(binary.BigEndian.Uint64(h[8:])), 16
+		case 0:
+			// size为0表示box延续到文件末尾。
+			size = end - pos
+		}
+
+		if size < hdr || pos+size > end {
+			return nil, fmt.Errorf("invalid mp4 box %q at %d", h[4:8], pos)
+		}
+		boxes = append(boxes, mp4Box{typ: string(h[4:8]), start: pos, hdr: hdr, end: pos + size})
+		pos += size
+	}
+	return boxes, nil
+}
+
+func findBox(boxes []mp4Box, typ string) *mp4Box {
+	for i := range boxes {
+		if boxes[i].typ == typ {
+			return &boxes[i]
+		}
+	}
+	return nil
+}
+
+func (b *mp4Box) payload(d []byte) []byte {
+	return d[b.start+b.hdr : b.end]
+}
+
+func makeBox(typ string, payload ...[]byte) []byte {
+	n := 8
+	for _, p := range payload {
+		n += len(p)
+	}
+
+	b := make([]byte, 8, n)
+	binary.BigEndian.PutUint32(b, uint32(n))
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+// mp4Tags 生成写入视频的描述、标题、作者和发布时间。
+func mp4Tags(item *oneItem, user *OneUser) []mp4Tag {
+	tags := []mp4Tag{
+		{"\xa9cmt", item.desc},
+		{"\xa9nam", item.title},
+		{"\xa9ART", user.account},
+	}
+	if !item.published.IsZero() {
+		tags = append(tags, mp4Tag{"\xa9day", item.published.Format(time.RFC3339)})
+	}
+	return tags
+}
+
+// writeMp4Tags 把tags写入moov/udta/meta/ilst，只重写moov，不重新编码。
+// moov位于文件末尾时原地重写，否则复制到新文件；moov位于mdat之前时，moov长度变化后同步调整stco/co64中的chunk偏移。
+func writeMp4Tags(path string, tags []mp4Tag) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	st, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	top, err := readBoxes(f, 0, st.Size())
+	if err != nil {
+		return err
+	}
+
+	moov := findBox(top, "moov")
+	if moov == nil {
+		return fmt.Errorf("no moov box in %s", path)
+	}
+
+	shift := false
+	for _, b := range top {
+		if b.typ == "mdat" && b.start > moov.start {
+			shift = true
+		}
+	}
+
+	n := memory.acquire((moov.end - moov.start) * 2)
+	defer memory.release(n)
+
+	d := make([]byte, moov.end-moov.start)
+	_, err = f.ReadAt(d, moov.start)
+	if err != nil {
+		return err
+	}
+
+	payload, err := setMoovTags(d[moov.hdr:], tags)
+	if err != nil {
+		return err
+	}
+
+	delta := int64(len(payload)+8) - int64(len(d))
+	if shift && delta != 0 {
+		err = shiftChunkOffsets(payload, delta)
+		if err != nil {
+			return err
+		}
+	}
+
+	box := makeBox("moov", payload)
+	if moov.end == st.Size() {
+		// moov在文件末尾时原地重写moov并截断，不复制mdat。
+		return rewriteTail(path, moov.start, box)
+	}
+
+	tmp := path + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0755)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, io.NewSectionReader(f, 0, moov.start))
+	if err == nil {
+		_, err = out.Write(box)
+	}
+	if err == nil {
+		_, err = io.Copy(out, io.NewSectionReader(f, moov.end, st.Size()-moov.end))
+	}
+	if cErr := out.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// rewriteTail 把文件从offset开始的内容替换为b。
+func rewriteTail(path string, offset int64, b []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.WriteAt(b, offset)
+	if err == nil {
+		err = f.Truncate(offset + int64(len(b)))
+	}
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// setMoovTags 返回写入tags后的moov内容，moov中其他box保持不变。
+func setMoovTags(moov []byte, tags []mp4Tag) ([]byte, error) {
+	children, err := readBoxes(bytes.NewReader(moov), 0, int64(len(moov)))
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(bytes.Buffer)
+	var udta []byte
+	for i := range children {
+		if children[i].typ == "udta" {
+			udta = children[i].payload(moov)
+			continue
+		}
+		out.Write(moov[children[i].start:children[i].end])
+	}
+
+	children, err = readBoxes(bytes.NewReader(udta), 0, int64(len(udta)))
+	if err != nil {
+		return nil, err
+	}
+
+	newUdta := new(bytes.Buffer)
+	var meta []byte
+	for i := range children {
+		if children[i].typ == "meta" {
+			meta = children[i].payload(udta)
+			continue
+		}
+		newUdta.Write(udta[children[i].start:children[i].end])
+	}
+
+	newMeta, err := setMetaTags(meta, tags)
+	if err != nil {
+		return nil, err
+	}
+	newUdta.Write(makeBox("meta", newMeta))
+	out.Write(makeBox("udta", newUdta.Bytes()))
+	return out.Bytes(), nil
+}
+
+// setMetaTags 返回写入tags后的meta内容，ilst中其他项保持不变。
+// ISO的meta为full box，QuickTime的meta没有version和flags，按原格式写回。
+func setMetaTags(meta []byte, tags []mp4Tag) ([]byte, error) {
+	out := new(bytes.Buffer)
+	if len(meta) < 8 || string(meta[4:8]) != "hdlr" {
+		out.Write([]byte{0, 0, 0, 0})
+		if len(meta) >= 4 {
+			meta = meta[4:]
+		}
+	}
+
+	children, err := readBoxes(bytes.NewReader(meta), 0, int64(len(meta)))
+	if err != nil {
+		return nil, err
+	}
+
+	if findBox(children, "hdlr") == nil {
+		// handler为mdir/appl，iTunes风格的元数据。
+		out.Write(makeBox("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9)))
+	}
+
+	var ilst []byte
+	for i := range children {
+		if children[i].typ == "ilst" {
+			ilst = children[i].payload(meta)
+			continue
+		}
+		out.Write(meta[children[i].start:children[i].end])
+	}
+
+	items, err := readBoxes(bytes.NewReader(ilst), 0, int64(len(ilst)))
+	if err != nil {
+		return nil, err
+	}
+
+	newIlst := new(bytes.Buffer)
+	for i := range items {
+		replaced := false
+		for _, t := range tags {
+			if t.value != "" && items[i].typ == t.key {
+				replaced = true
+			}
+		}
+		if !replaced {
+			newIlst.Write(ilst[items[i].start:items[i].end])
+		}
+	}
+
+	for _, t := range tags {
+		if t.value == "" {
+			continue
+		}
+		// data的类型为1表示UTF-8文本，locale为0。
+		newIlst.Write(makeBox(t.key, makeBox("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(t.value))))
+	}
+	out.Write(makeBox("ilst", newIlst.Bytes()))
+	return out.Bytes(), nil
+}
+
+// shiftChunkOffsets 把moov中所有track的stco/co64 chunk偏移加上delta。
+func shiftChunkOffsets(b []byte, delta int64) error {
+	boxes, err := readBoxes(bytes.NewReader(b), 0, int64(len(b)))
+	if err != nil {
+		return err
+	}
+
+	for i := range boxes {
+		p := boxes[i].payload(b)
+		switch boxes[i].typ {
+		case "trak", "mdia", "minf", "stbl":
+			err = shiftChunkOffsets(p, delta)
+			if err != nil {
+				return err
+			}
+		case "stco", "co64":
+			if len(p) < 8 {
+				return fmt.Errorf("invalid %s box", boxes[i].typ)
+			}
+
+			size := 4
+			if boxes[i].typ == "co64" {
+				size = 8
+			}
+			count := int(binary.BigEndian.Uint32(p[4:]))
+			if len(p) < 8+count*size {
+				return fmt.Errorf("invalid %s box, %d entries", boxes[i].typ, count)
+			}
+
+			for j := 0; j < count; j++ {
+				e := p[8+j*size:]
+				if size == 8 {
+					binary.BigEndian.PutUint64(e, uint64(int64(binary.BigEndian.Uint64(e))+delta))
+					continue
+				}
+
+				v := int64(binary.BigEndian.Uint32(e)) + delta
+				if v < 0 || v > math.MaxUint32 {
+					return fmt.Errorf("chunk offset overflow: %d", v)
+				}
+				binary.BigEndian.PutUint32(e, uint32(v))
+			}
+		}
+	}
+	return nil
+}
+
+// videoInfo 为从moov中解析出的视频信息。
+type videoInfo struct {
+	Duration time.Duration
+	Width    int
+	Height   int
+	Codec    string
+}
+
+// inspectMp4 解析moov中的mvhd、tkhd和stsd，得到时长、视频轨道的分辨率和编码。
+func inspectMp4(path string) (*videoInfo, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	st, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	top, err := readBoxes(f, 0, st.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	moov := findBox(top, "moov")
+	if moov == nil {
+		return nil, fmt.Errorf("no moov box in %s", path)
+	}
+
+	n := memory.acquire(moov.end - moov.start)
+	defer memory.release(n)
+
+	d := make([]byte, moov.end-moov.start-moov.hdr)
+	_, err = f.ReadAt(d, moov.start+moov.hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := readBoxes(bytes.NewReader(d), 0, int64(len(d)))
+	if err != nil {
+		return nil, err
+	}
+
+	v := &videoInfo{}
+	if mvhd := findBox(children, "mvhd"); mvhd != nil {
+		v.Duration = mvhdDuration(mvhd.payload(d))
+	}
+
+	for i := range children {
+		if children[i].typ == "trak" && inspectTrak(children[i].payload(d), v) {
+			break
+		}
+	}
+	return v, nil
+}
+
+func mvhdDuration(p []byte) time.Duration {
+	var timescale, duration uint64
+	switch {
+	case len(p) >= 32 && p[0] == 1:
+		timescale, duration = uint64(binary.BigEndian.Uint32(p[20:])), binary.BigEndian.Uint64(p[24:])
+	case len(p) >= 20:
+		timescale, duration = uint64(binary.BigEndian.Uint32(p[12:])), uint64(binary.BigEndian.Uint32(p[16:]))
+	}
+
+	// fragmented MP4的时长为0或全1，此时返回0表示未知。
+	if timescale == 0 || duration == 0 || duration == 0xFFFFFFFF || duration == 0xFFFFFFFFFFFFFFFF {
+		return 0
+	}
+	return time.Duration(float64(duration) / float64(timescale) * float64(time.Second))
+}
+
+// inspectTrak 从视频轨道中读取分辨率和编码，不是视频轨道时返回false。
+func inspectTrak(trak []byte, v *videoInfo) bool {
+	boxes, err := readBoxes(bytes.NewReader(trak), 0, int64(len(trak)))
+	if err != nil {
+		return false
+	}
+
+	mdia := findBox(boxes, "mdia")
+	if mdia == nil {
+		return false
+	}
+	md := mdia.payload(trak)
+	hdlr := childBox(md, "hdlr")
+	if len(hdlr) < 12 || string(hdlr[8:12]) != "vide" {
+		return false
+	}
+
+	// tkhd末尾为16.16定点数的宽和高。
+	if tkhd := findBox(boxes, "tkhd"); tkhd != nil {
+		p := tkhd.payload(trak)
+		if len(p) >= 8 {
+			v.Width = int(binary.BigEndian.Uint32(p[len(p)-8:]) >> 16)
+			v.Height = int(binary.BigEndian.Uint32(p[len(p)-4:]) >> 16)
+		}
+	}
+
+	stsd := childBox(childBox(childBox(md, "minf"), "stbl"), "stsd")
+	// stsd中第一个sample entry的类型为编码，视觉类sample entry中偏移24处为宽和高。
+	if len(stsd) >= 16 {
+		entry := stsd[8:]
+		v.Codec = string(entry[4:8])
+		if (v.Width == 0 || v.Height == 0) && len(entry) >= 36 {
+			v.Width = int(binary.BigEndian.Uint16(entry[32:]))
+			v.Height = int(binary.BigEndian.Uint16(entry[34:]))
+		}
+	}
+	return true
+}
+
+// childBox 返回d中第一个类型为typ的box的内容，不存在时返回nil。
+func childBox(d []byte, typ string) []byte {
+	boxes, err := readBoxes(bytes.NewReader(d), 0, int64(len(d)))
+	if err != nil {
+		return nil
+	}
+	if b := findBox(boxes, typ); b != nil {
+		return b.payload(d)
+	}
+	return nil
+}
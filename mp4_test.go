@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+// testMp4 生成一个只有一个视频轨道和一个chunk的MP4，faststart时moov在mdat之前，udta为moov中额外的udta内容。
+func testMp4(faststart bool, udta []byte) (file []byte, data []byte) {
+	mvhd := make([]byte, 100)
+	copy(mvhd[12:], u32(1000))
+	copy(mvhd[16:], u32(12000))
+	tkhd := make([]byte, 84)
+	copy(tkhd[76:], u32(1280<<16))
+	copy(tkhd[80:], u32(720<<16))
+	hdlr := append(append(make([]byte, 8), "vide"...), make([]byte, 13)...)
+	entry := append(append(u32(86), "avc1"...), make([]byte, 78)...)
+	stsd := append(append(make([]byte, 4), u32(1)...), entry...)
+
+	data = make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	ftyp := makeBox("ftyp", []byte("isom\x00\x00\x02\x00isomiso2mp41"))
+	mdat := makeBox("mdat", data)
+	moov := func(offset uint32) []byte {
+		stco := append(append(make([]byte, 4), u32(1)...), u32(offset)...)
+		stbl := makeBox("stbl", makeBox("stsd", stsd), makeBox("stco", stco))
+		trak := makeBox("trak", makeBox("tkhd", tkhd), makeBox("mdia", makeBox("hdlr", hdlr), makeBox("minf", stbl)))
+		boxes := [][]byte{makeBox("mvhd", mvhd), trak}
+		if udta != nil {
+			boxes = append(boxes, makeBox("udta", udta))
+		}
+		return makeBox("moov", boxes...)
+	}
+
+	if faststart {
+		size := len(moov(0))
+		return bytes.Join([][]byte{ftyp, moov(uint32(len(ftyp) + size + 8)), mdat}, nil), data
+	}
+	return bytes.Join([][]byte{ftyp, mdat, moov(uint32(len(ftyp) + 8))}, nil), data
+}
+
+// ilstItem 生成ilst中的一项UTF-8文本元数据。
+func ilstItem(key, value string) []byte {
+	return makeBox(key, makeBox("data", []byte{0, 0, 0, 1, 0, 0, 0, 0}, []byte(value)))
+}
+
+// readMoov 返回文件中moov的内容。
+func readMoov(t *testing.T, d []byte) []byte {
+	top, err := readBoxes(bytes.NewReader(d), 0, int64(len(d)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	moov := findBox(top, "moov")
+	if moov == nil {
+		t.Fatal("no moov box")
+	}
+	return moov.payload(d)
+}
+
+// readIlst 返回moov/udta/meta/ilst中的文本元数据。
+func readIlst(t *testing.T, moov []byte) map[string]string {
+	meta := childBox(childBox(moov, "udta"), "meta")
+	if len(meta) < 4 {
+		t.Fatal("no meta box")
+	}
+	ilst := childBox(meta[4:], "ilst")
+	items, err := readBoxes(bytes.NewReader(ilst), 0, int64(len(ilst)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := map[string]string{}
+	for i := range items {
+		data := childBox(items[i].payload(ilst), "data")
+		if len(data) < 8 {
+			t.Fatalf("invalid ilst item %q", items[i].typ)
+		}
+		tags[items[i].typ] = string(data[8:])
+	}
+	return tags
+}
+
+func chunkOffset(t *testing.T, moov []byte) uint32 {
+	stbl := childBox(childBox(childBox(childBox(moov, "trak"), "mdia"), "minf"), "stbl")
+	stco := childBox(stbl, "stco")
+	if len(stco) < 12 {
+		t.Fatal("no stco box")
+	}
+	return binary.BigEndian.Uint32(stco[8:])
+}
+
+func TestWriteMp4Tags(t *testing.T) {
+	memory = newMemBudget(1 << 20)
+	existing := makeBox("meta", make([]byte, 4),
+		makeBox("hdlr", make([]byte, 8), []byte("mdirappl"), make([]byte, 9)),
+		makeBox("ilst", ilstItem("\xa9too", "encoder"), ilstItem("\xa9cmt", "old")))
+
+	cases := []struct {
+		name      string
+		faststart bool
+		udta      []byte
+	}{
+		{"faststart", true, nil},
+		{"moov after mdat", false, nil},
+		{"existing ilst faststart", true, existing},
+		{"existing ilst", false, existing},
+		{"shorter moov at the end", false, makeBox("meta", make([]byte, 4), makeBox("ilst", ilstItem("\xa9cmt", strings.Repeat("x", 1000))))},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src, data := testMp4(c.faststart, c.udta)
+			path := filepath.Join(t.TempDir(), "a.mp4")
+			if err := ioutil.WriteFile(path, src, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err := writeMp4Tags(path, []mp4Tag{{"\xa9cmt", "你好 #tag"}, {"\xa9ART", "seed"}, {"\xa9nam", ""}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := ioutil.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			moov := readMoov(t, d)
+			// moov在文件末尾时原地重写，之前的内容不变，文件截断到新moov的末尾。
+			if !c.faststart {
+				head := len(src) - len(readMoov(t, src)) - 8
+				if !bytes.Equal(d[:head], src[:head]) || len(d) != head+len(moov)+8 {
+					t.Fatal("unexpected file layout after rewriting moov at the end")
+				}
+			}
+			if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+				t.Fatal("tmp file left")
+			}
+
+			off := chunkOffset(t, moov)
+			if int(off)+len(data) > len(d) || !bytes.Equal(d[off:int(off)+len(data)], data) {
+				t.Fatalf("chunk offset %d does not point to the mdat data", off)
+			}
+
+			tags := readIlst(t, moov)
+			if tags["\xa9cmt"] != "你好 #tag" || tags["\xa9ART"] != "seed" {
+				t.Fatalf("unexpected tags: %q", tags)
+			}
+			if _, ok := tags["\xa9nam"]; ok {
+				t.Fatalf("empty tag written: %q", tags)
+			}
+			if bytes.Contains(c.udta, []byte("\xa9too")) && tags["\xa9too"] != "encoder" {
+				t.Fatalf("existing tag lost: %q", tags)
+			}
+
+			v, err := inspectMp4(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.Duration != 12*time.Second || v.Width != 1280 || v.Height != 720 || v.Codec != "avc1" {
+				t.Fatalf("unexpected video info: %+v", v)
+			}
+		})
+	}
+}
+
+func TestMvhdDurationUnknown(t *testing.T) {
+	p := make([]byte, 100)
+	copy(p[12:], u32(1000))
+	if d := mvhdDuration(p); d != 0 {
+		t.Fatalf("got %s, expect 0", d)
+	}
+
+	copy(p[16:], u32(0xFFFFFFFF))
+	if d := mvhdDuration(p); d != 0 {
+		t.Fatalf("got %s, expect 0", d)
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 与已有图片近似（感知hash的汉明距离不超过阈值）时，对分辨率较低一方的处理方式。
+const (
+	NearDuplicateDrop       = "drop"
+	NearDuplicateQuarantine = "quarantine"
+)
+
+func checkNearDuplicateAction(action string) error {
+	switch action {
+	case "", NearDuplicateDrop, NearDuplicateQuarantine:
+		return nil
+	}
+	return fmt.Errorf("invalid near_duplicate_action: %q", action)
+}
+
+func imageConfig(path string) (image.Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	c, _, err := image.DecodeConfig(f)
+	return c, err
+}
+
+// imageDHash 计算图片的dHash：缩放为9x8的灰度图后比较每行相邻像素的亮度，得到64位hash。
+func imageDHash(path string, c image.Config) (uint64, error) {
+	// 解码后的图片按每像素4字节计算内存。
+	n := memory.acquire(int64(c.Width) * int64(c.Height) * 4)
+	defer memory.release(n)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return 0, err
+	}
+
+	var gray [8][9]uint64
+	b := img.Bounds()
+	for y := 0; y < 8; y++ {
+		y0 := b.Min.Y + y*b.Dy()/8
+		y1 := b.Min.Y + (y+1)*b.Dy()/8
+		for x := 0; x < 9; x++ {
+			x0 := b.Min.X + x*b.Dx()/9
+			x1 := b.Min.X + (x+1)*b.Dx()/9
+			gray[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				h |= 1
+			}
+		}
+	}
+	return h, nil
+}
+
+// averageLuma 计算区域内的平均亮度，区域过大时按步长采样。
+func averageLuma(img image.Image, x0, y0, x1, y1 int) uint64 {
+	if x1 <= x0 {
+		x1 = x0 + 1
+	}
+	if y1 <= y0 {
+		y1 = y0 + 1
+	}
+
+	step := 1
+	for (x1-x0)/step*(y1-y0)/step > 1024 {
+		step *= 2
+	}
+
+	var sum, count uint64
+	for y := y0; y < y1; y += step {
+		for x := x0; x < x1; x += step {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += (299*uint64(r) + 587*uint64(g) + 114*uint64(b)) / 1000
+			count++
+		}
+	}
+	return sum / count
+}
+
+func formatPHash(h uint64) string {
+	return fmt.Sprintf("%016x", h)
+}
+
+func parsePHash(s string) (uint64, bool) {
+	h, err := strconv.ParseUint(s, 16, 64)
+	return h, err == nil
+}
+
+func hamming(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+func phashBytes(h uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, h)
+	return b
+}
+
+// discardNearDuplicate 按action删除或隔离分辨率较低的近似图片，返回隔离后的路径，删除时返回空。
+func discardNearDuplicate(action, path string) (string, error) {
+	if action != NearDuplicateQuarantine {
+		return "", os.Remove(path)
+	}
+
+	// 在quarantine目录中保留文件在photo_dir下的相对路径，不同目录中的同名文件不会互相覆盖。
+	name := strings.TrimSuffix(path, ".tmp")
+	rel, err := filepath.Rel(photoDir, name)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		rel = filepath.Base(name)
+	}
+
+	dst := filepath.Join(quarantineDir, rel)
+	err = os.MkdirAll(filepath.Dir(dst), os.ModeDir|0755)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := os.Lstat(dst); err == nil {
+		dst = nextFreeName(dst)
+	}
+	return dst, os.Rename(path, dst)
+}
+
+// replaceNearDuplicate 新图片分辨率更高时，删除或隔离已有的近似图片，并把其记录指向新条目。
+func replaceNearDuplicate(old *Record, key string, c image.Config) {
+	action := config.nearDuplicateAction()
+	path, err := discardNearDuplicate(action, old.Path)
+	if err != nil {
+		log.Warnf("failed to %s near duplicate: %s, err: %s", action, old.Path, err.Error())
+		return
+	}
+
+	log.Warnf("near duplicate: %s, %dx%d, replaced by %dx%d, action: %s", old.Path, old.Width, old.Height, c.Width, c.Height, action)
+	old.Path = path
+	old.DuplicateOf = key
+	err = index.put(old)
+	if err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 目标路径已存在同名文件时的处理策略。
+const (
+	// ReplaceBySize 保留字节数更大的文件。
+	ReplaceBySize = "size"
+	// ReplaceByResolution 保留像素更多的文件，像素相同或无法解析时按size比较。
+	ReplaceByResolution = "resolution"
+	// ReplaceNewest 总是用新下载的文件替换。
+	ReplaceNewest = "newest"
+	// ReplaceKeepBoth 两个都保留，新文件名加数字后缀。
+	ReplaceKeepBoth = "keep_both"
+)
+
+func checkReplacePolicy(policy string) error {
+	switch policy {
+	case "", ReplaceBySize, ReplaceByResolution, ReplaceNewest, ReplaceKeepBoth:
+		return nil
+	}
+	return fmt.Errorf("invalid replace_policy: %q", policy)
+}
+
+type candidate struct {
+	path    string
+	size    int64
+	width   int
+	height  int
+	modTime time.Time
+}
+
+func inspectCandidate(path string) candidate {
+	c := candidate{path: path}
+	if st, err := os.Stat(path); err == nil {
+		c.size = st.Size()
+		c.modTime = st.ModTime()
+	}
+	if ic, err := imageConfig(path); err == nil {
+		c.width, c.height = ic.Width, ic.Height
+	}
+	return c
+}
+
+func (c candidate) String() string {
+	return fmt.Sprintf("%s(%dx%d, %d bytes, %s)", c.path, c.width, c.height, c.size, c.modTime.Format("2006-01-02 15:04:05"))
+}
+
+// sameNameTarget 在dst已存在时按policy决定新文件newPath的去向：
+// 返回dst表示覆盖，返回其他路径表示两者都保留，返回空表示丢弃新文件。
+// 两者都保留时新路径由条目key占用，调用方需要在转正后releaseName。
+func sameNameTarget(policy, newPath, dst, key string) string {
+	n, o := inspectCandidate(newPath), inspectCandidate(dst)
+
+	var target string
+	switch policy {
+	case ReplaceNewest:
+		target = dst
+	case ReplaceKeepBoth:
+		target = claimFreeName(dst, key)
+	case ReplaceByResolution:
+		np, op := n.width*n.height, o.width*o.height
+		if np > 0 && op > 0 && np != op {
+			if np > op {
+				target = dst
+			}
+			break
+		}
+		fallthrough
+	default:
+		if o.size < n.size {
+			target = dst
+		}
+	}
+
+	decision := "keep existing"
+	if target == dst {
+		decision = "replace"
+	} else if target != "" {
+		decision = "keep both as " + target
+	}
+	log.Warnf("same name file, policy: %s, decision: %s, existing: %s, new: %s", policy, decision, o, n)
+	return target
+}
+
+// nextFreeName 返回name_1.ext、name_2.ext...中第一个不存在的路径。
+func nextFreeName(path string) string {
+	ext := filepath.Ext(path)
+	base := strings.TrimSuffix(path, ext)
+	for i := 1; ; i++ {
+		p := fmt.Sprintf("%s_%d%s", base, i, ext)
+		if _, err := os.Lstat(p); os.IsNotExist(err) {
+			return p
+		}
+	}
+}
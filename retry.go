@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultMaxAttempts = 3
+	DefaultBackoff     = 2 * time.Second
+	DefaultMaxBackoff  = time.Minute
+)
+
+// RetryPolicy 失败重试策略，第n次重试前等待backoff*2^(n-1)，不超过max_backoff，再加上[0, jitter)的随机时间。
+type RetryPolicy struct {
+	MaxAttempts int           `yaml:"max_attempts,omitempty"`
+	Backoff     time.Duration `yaml:"backoff,omitempty"`
+	MaxBackoff  time.Duration `yaml:"max_backoff,omitempty"`
+	Jitter      time.Duration `yaml:"jitter,omitempty"`
+}
+
+// merge 用o中非零的配置覆盖p。
+func (p RetryPolicy) merge(o RetryPolicy) RetryPolicy {
+	if o.MaxAttempts > 0 {
+		p.MaxAttempts = o.MaxAttempts
+	}
+	if o.Backoff > 0 {
+		p.Backoff = o.Backoff
+	}
+	if o.MaxBackoff > 0 {
+		p.MaxBackoff = o.MaxBackoff
+	}
+	if o.Jitter > 0 {
+		p.Jitter = o.Jitter
+	}
+	return p
+}
+
+func defaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: DefaultMaxAttempts,
+		Backoff:     DefaultBackoff,
+		MaxBackoff:  DefaultMaxBackoff,
+	}
+}
+
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < attempt && d < p.MaxBackoff; i++ {
+		d *= 2
+	}
+	if d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+// do 执行fn，遇到可重试的错误时按策略等待后重试，收到退出信号后不再重试。
+func (p RetryPolicy) do(what string, fn func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return nil
+		}
+
+		ok, after := retryable(err)
+		if !ok || attempt >= p.MaxAttempts {
+			return err
+		}
+
+		wait := p.backoff(attempt)
+		if after > 0 {
+			// 服务端要求等待的时间超过上限时，本轮不再重试。
+			if after > p.MaxBackoff {
+				return err
+			}
+			wait = after
+		}
+
+		log.Warnf("%s, attempt %d/%d failed: %s, retry after %s", what, attempt, p.MaxAttempts, err.Error(), wait)
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-runCtx.Done():
+			t.Stop()
+			return err
+		}
+	}
+}
+
+// statusError 表示非200的http响应。
+type statusError struct {
+	url        string
+	code       int
+	retryAfter time.Duration
+}
+
+func newStatusError(res *http.Response) *statusError {
+	return &statusError{
+		url:        res.Request.URL.String(),
+		code:       res.StatusCode,
+		retryAfter: parseRetryAfter(res.Header.Get("Retry-After")),
+	}
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s, http status: %d %s", e.url, e.code, http.StatusText(e.code))
+}
+
+func parseRetryAfter(v string) time.Duration {
+	if v == "" {
+		return 0
+	}
+
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+// permanentFailure 判断错误是否为重试也不会成功的http状态，例如404、410。
+func permanentFailure(err error) bool {
+	var se *statusError
+	return errors.As(err, &se) && !retryableStatus(se.code)
+}
+
+func retryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// retryable 判断错误是否值得重试，并返回服务端要求的等待时间。
+// 超时、连接被重置、5xx、429以及内容校验失败可以重试，404、410等其他4xx以及解析错误视为永久失败。
+func retryable(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) {
+		return false, 0
+	}
+
+	var se *statusError
+	if errors.As(err, &se) {
+		return retryableStatus(se.code), se.retryAfter
+	}
+
+	var ve *validationError
+	if errors.As(err, &ve) {
+		return true, 0
+	}
+
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true, 0
+	}
+
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
+		return true, 0
+	}
+
+	var de *net.DNSError
+	if errors.As(err, &de) && de.Temporary() {
+		return true, 0
+	}
+
+	return false, 0
+}
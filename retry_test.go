@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestRetryable(t *testing.T) {
+	cases := []struct {
+		name  string
+		err   error
+		want  bool
+		after time.Duration
+	}{
+		{"429", &statusError{code: 429, retryAfter: 3 * time.Second}, true, 3 * time.Second},
+		{"503", &statusError{code: 503}, true, 0},
+		{"404", &statusError{code: 404}, false, 0},
+		{"416", &statusError{code: 416}, false, 0},
+		{"wrapped 500", fmt.Errorf("get: %w", &statusError{code: 500}), true, 0},
+		{"validation", &validationError{url: "u", reason: "truncated"}, true, 0},
+		{"unexpected eof", fmt.Errorf("u: %w", io.ErrUnexpectedEOF), true, 0},
+		{"connection reset", &os.SyscallError{Syscall: "read", Err: syscall.ECONNRESET}, true, 0},
+		{"canceled", fmt.Errorf("get: %w", context.Canceled), false, 0},
+		{"other", errors.New("parse error"), false, 0},
+	}
+
+	for _, c := range cases {
+		ok, after := retryable(c.err)
+		if ok != c.want || after != c.after {
+			t.Errorf("%s: got %v %s, expect %v %s", c.name, ok, after, c.want, c.after)
+		}
+	}
+}
+
+func TestPermanentFailure(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{&statusError{code: 404}, true},
+		{fmt.Errorf("get: %w", &statusError{code: 410}), true},
+		{&statusError{code: 503}, false},
+		{&validationError{url: "u", reason: "truncated"}, false},
+		{context.Canceled, false},
+		{errors.New("disk full"), false},
+	}
+
+	for _, c := range cases {
+		if got := permanentFailure(c.err); got != c.want {
+			t.Errorf("%v: got %v, expect %v", c.err, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"github.com/robfig/cron/v3"
+	log "github.com/sirupsen/logrus"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+const DefaultInterval = 300 * time.Second
+
+// schedule 返回t之后的下一次运行时间，cron.Schedule同样满足该接口。
+type schedule interface {
+	Next(t time.Time) time.Time
+}
+
+type everySchedule struct {
+	interval time.Duration
+}
+
+func (s everySchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// plan 记录一个账号的调度信息，running为该账号尚未完成的任务数。
+type plan struct {
+	account  *Account
+	schedule schedule
+	jitter   time.Duration
+	next     time.Time
+	running  int32
+}
+
+func newSchedule(a *Account, c *Conf) (schedule, error) {
+	if a.Cron != "" {
+		s, err := cron.ParseStandard(a.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("account %s, invalid cron: %q, %s", a.name(), a.Cron, err.Error())
+		}
+		return s, nil
+	}
+
+	interval := a.Interval
+	if interval <= 0 {
+		interval = c.Interval
+	}
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+
+	return everySchedule{interval: interval}, nil
+}
+
+func newPlans(c *Conf) ([]*plan, error) {
+	var plans []*plan
+	now := time.Now()
+	for i := range c.Accounts {
+		a := &c.Accounts[i]
+		s, err := newSchedule(a, c)
+		if err != nil {
+			return nil, err
+		}
+
+		jitter := a.Jitter
+		if jitter <= 0 {
+			jitter = c.Jitter
+		}
+		plans = append(plans, &plan{account: a, schedule: s, jitter: jitter, next: now})
+	}
+
+	return plans, nil
+}
+
+func (p *plan) scheduleNext(now time.Time) {
+	p.next = p.schedule.Next(now)
+	if p.jitter > 0 {
+		p.next = p.next.Add(time.Duration(rand.Int63n(int64(p.jitter))))
+	}
+}
+
+func logPlans(plans []*plan) {
+	for _, p := range plans {
+		log.Warnf("[%s], next run at %s", p.account.name(), p.next.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// serve 常驻运行，按每个账号自己的interval/cron把任务投递到ch中。
+func serve(ch chan *OneUser) error {
+	plans, err := newPlans(config)
+	if err != nil {
+		return err
+	}
+	if len(plans) == 0 {
+		return fmt.Errorf("no account configured")
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	for {
+		sort.Slice(plans, func(i, j int) bool {
+			return plans[i].next.Before(plans[j].next)
+		})
+
+		t := time.NewTimer(time.Until(plans[0].next))
+		select {
+		case <-t.C:
+		case <-runCtx.Done():
+			t.Stop()
+			return nil
+		}
+
+		now := time.Now()
+		for _, p := range plans {
+			if p.next.After(now) {
+				continue
+			}
+
+			p.scheduleNext(now)
+			if atomic.LoadInt32(&p.running) > 0 {
+				log.Warnf("[%s], last round is still running, skip this round", p.account.name())
+				continue
+			}
+
+			if !runPlan(ch, p) {
+				return nil
+			}
+		}
+
+		logPlans(plans)
+	}
+}
+
+func runPlan(ch chan *OneUser, p *plan) bool {
+	src, _ := getSource(p.account.Type)
+	tasks := src.Tasks(p.account)
+	atomic.AddInt32(&p.running, int32(len(tasks)))
+	for i, o := range tasks {
+		o.onDone = func() {
+			atomic.AddInt32(&p.running, -1)
+		}
+		if !addOneTask(ch, o) {
+			atomic.AddInt32(&p.running, -int32(len(tasks)-i))
+			return false
+		}
+	}
+
+	return true
+}
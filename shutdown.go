@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	DefaultShutdownTimeout = 30 * time.Second
+	// 超过该时间仍未续传完成的文件视为废弃。
+	PartialExpire = 7 * 24 * time.Hour
+)
+
+var (
+	// runCtx 在收到SIGINT/SIGTERM后取消，此后不再投递任务，也不再开始新的下载。
+	runCtx context.Context
+	// abortCtx 在收到信号后超过shutdown_timeout仍未退出时取消，用于中断进行中的请求。
+	abortCtx context.Context
+)
+
+func setupShutdown(timeout time.Duration) {
+	var (
+		stop   context.CancelFunc
+		cancel context.CancelFunc
+	)
+	runCtx, stop = signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	abortCtx, cancel = context.WithCancel(context.Background())
+	if timeout <= 0 {
+		timeout = DefaultShutdownTimeout
+	}
+
+	go func() {
+		<-runCtx.Done()
+		stop()
+		log.Warnf("received exit signal, waiting at most %s for in-flight downloads.", timeout)
+		time.Sleep(timeout)
+		log.Warnf("shutdown timeout, cancel all in-flight downloads.")
+		cancel()
+	}()
+}
+
+func stopping() bool {
+	return runCtx.Err() != nil
+}
+
+// cleanTmpFiles 删除上次异常退出时遗留的半成品.tmp文件。
+func cleanTmpFiles(dir string) {
+	count := 0
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() || !strings.HasSuffix(path, ".tmp") {
+			return nil
+		}
+
+		err = os.Remove(path)
+		if err != nil {
+			log.Warnf("failed to remove tmp file: %s, err: %s", path, err.Error())
+			return nil
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		log.Warnf("failed to clean tmp files in %s, err: %s", dir, err.Error())
+	}
+
+	if count > 0 {
+		log.Warnf("removed %d orphaned tmp files in %s", count, dir)
+	}
+}
+
+// cleanPartialFiles 删除长时间没有续传的未完成文件。
+func cleanPartialFiles(dir string, expire time.Duration) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Warnf("failed to read dir: %s, err: %s", dir, err.Error())
+		return
+	}
+
+	for _, info := range infos {
+		if info.IsDir() || time.Since(info.ModTime()) < expire {
+			continue
+		}
+		_ = os.Remove(filepath.Join(dir, info.Name()))
+	}
+}
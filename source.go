@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Source 描述一种订阅源：根据账号配置生成抓取任务，任务中已带有解析条目的Parser和代理设置。
+// 新的订阅类型只需实现该接口并在init中调用RegisterSource注册即可。
+type Source interface {
+	Tasks(account *Account) []*OneUser
+}
+
+// ProxyDefaults 为true的项会强制走代理，与账号中的feed_use_proxy/content_use_proxy取或。
+type ProxyDefaults struct {
+	Feed    bool
+	Content bool
+}
+
+var sources = map[string]Source{}
+
+func RegisterSource(name string, s Source) {
+	if _, ok := sources[name]; ok {
+		panic(fmt.Sprintf("source type %q registered twice", name))
+	}
+	sources[name] = s
+}
+
+func getSource(name string) (Source, error) {
+	s, ok := sources[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown account type: %q, supported types: %s", name, strings.Join(sourceNames(), ", "))
+	}
+
+	return s, nil
+}
+
+func sourceNames() []string {
+	var names []string
+	for n := range sources {
+		if n == "" {
+			continue
+		}
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// feedSource 是基于RSS订阅的通用Source实现，每个seed按urls生成一个或多个任务。
+type feedSource struct {
+	parser Parser
+	proxy  ProxyDefaults
+	urls   func(seed string, account *Account) []string
+	// dirTemplate 返回该类型账号未配置dir_template时使用的目录模板。
+	dirTemplate func(account *Account) string
+}
+
+func (s *feedSource) Tasks(account *Account) []*OneUser {
+	var users []*OneUser
+	now := time.Now()
+	for _, seed := range account.Seeds {
+		for _, u := range s.urls(seed, account) {
+			o := &OneUser{
+				account:     seed,
+				dirTemplate: config.dirTemplate(account, s.dirTemplate(account)),
+				rsshubUrl:   u,
+				parser:      s.parser,
+				noDesc:      account.NoDesc,
+				aType:       account.Type,
+				aName:       account.name(),
+				acc:         account,
+				limiter:     account.rateLimiter(),
+				retry:       config.retryPolicy(account),
+				runTime:     now,
+			}
+			SetHttpClient(o, account, s.proxy)
+			users = append(users, o)
+		}
+	}
+
+	return users
+}
+
+func SetHttpClient(u *OneUser, account *Account, proxy ProxyDefaults) {
+	u.feedParserClient = clientWithoutProxy
+	u.contentClient = clientWithoutProxy
+	if account.FeedUseProxy || proxy.Feed {
+		u.feedParserClient = client
+	}
+
+	if account.ContentUseProxy || proxy.Content {
+		u.contentClient = client
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"golang.org/x/time/rate"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type accountLimiterKey struct{}
+
+// withAccountLimiter 把账号级的限速器放入请求的context，由transport在发请求前等待。
+func withAccountLimiter(ctx context.Context, l *rate.Limiter) context.Context {
+	if l == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, accountLimiterKey{}, l)
+}
+
+func newRateLimiter(r RateLimit) *rate.Limiter {
+	if r.Rate <= 0 {
+		return nil
+	}
+
+	burst := r.Burst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(rate.Limit(r.Rate), burst)
+}
+
+// hostLimiter 限制每个host的并发请求数与请求速率，代理与非代理的client共享同一份计数。
+// host_limits/rate_limits中的key可以是完整域名，也可以是上级域名（如twimg.com对所有子域名生效）。
+type hostLimiter struct {
+	limits           map[string]int
+	defaultLimit     int
+	rateLimits       map[string]RateLimit
+	defaultRateLimit RateLimit
+
+	mu       sync.Mutex
+	sems     map[string]chan struct{}
+	limiters map[string]*rate.Limiter
+}
+
+func newHostLimiter(c *Conf) *hostLimiter {
+	return &hostLimiter{
+		limits:           c.HostLimits,
+		defaultLimit:     c.DefaultHostLimit,
+		rateLimits:       c.RateLimits,
+		defaultRateLimit: c.DefaultRateLimit,
+		sems:             map[string]chan struct{}{},
+		limiters:         map[string]*rate.Limiter{},
+	}
+}
+
+// matchHost 按域名层级查找配置，返回命中的key，未命中时返回host本身。
+func matchHost(host string, found func(h string) bool) string {
+	for h := host; h != ""; {
+		if found(h) {
+			return h
+		}
+		i := strings.IndexByte(h, '.')
+		if i < 0 {
+			break
+		}
+		h = h[i+1:]
+	}
+	return host
+}
+
+func (l *hostLimiter) sem(host string) chan struct{} {
+	key := matchHost(host, func(h string) bool {
+		_, ok := l.limits[h]
+		return ok
+	})
+	limit, ok := l.limits[key]
+	if !ok {
+		limit = l.defaultLimit
+	}
+
+	if limit <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.sems[key]
+	if !ok {
+		s = make(chan struct{}, limit)
+		l.sems[key] = s
+	}
+	return s
+}
+
+func (l *hostLimiter) limiter(host string) *rate.Limiter {
+	key := matchHost(host, func(h string) bool {
+		_, ok := l.rateLimits[h]
+		return ok
+	})
+	r, ok := l.rateLimits[key]
+	if !ok {
+		r = l.defaultRateLimit
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rl, ok := l.limiters[key]
+	if !ok {
+		rl = newRateLimiter(r)
+		l.limiters[key] = rl
+	}
+	return rl
+}
+
+func (l *hostLimiter) wrap(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &limitedTransport{base: base, limiter: l}
+}
+
+type limitedTransport struct {
+	base    http.RoundTripper
+	limiter *hostLimiter
+}
+
+// RoundTrip 先等待账号和host的限速令牌，再拿到host的并发名额后才发出请求，名额直到响应Body关闭时才释放。
+func (t *limitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	if al, ok := ctx.Value(accountLimiterKey{}).(*rate.Limiter); ok {
+		if err := al.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	if hl := t.limiter.limiter(req.URL.Hostname()); hl != nil {
+		if err := hl.Wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	sem := t.limiter.sem(req.URL.Hostname())
+	if sem == nil {
+		return t.base.RoundTrip(req)
+	}
+
+	select {
+	case sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+
+	res, err := t.base.RoundTrip(req)
+	if err != nil {
+		<-sem
+		return nil, err
+	}
+
+	res.Body = &releaseBody{ReadCloser: res.Body, release: func() {
+		<-sem
+	}}
+	return res, nil
+}
+
+type releaseBody struct {
+	io.ReadCloser
+	once    sync.Once
+	release func()
+}
+
+func (b *releaseBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.release)
+	return err
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"os"
+)
+
+// tailSize 检查文件结束标记时读取的文件尾部长度，容忍结束标记后的少量填充数据。
+const tailSize = 1024
+
+var (
+	jpegEOI = []byte{0xFF, 0xD9}
+	pngIEND = []byte("IEND")
+)
+
+// validationError 表示下载的内容未通过校验，例如返回了HTML页面或文件被截断，可以重试。
+type validationError struct {
+	url    string
+	reason string
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf("%s, invalid content: %s", e.url, e.reason)
+}
+
+// validateFile 在文件提升为正式文件前校验其内容，返回检测到的文件类型。
+// 依次检查文件类型与Content-Type、JPEG/PNG的结束标记，并对图片完整解码一次。
+func validateFile(u, path, ct string) (string, error) {
+	sniffed, err := sniffFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	ft, err := checkMediaType(sniffed, ct, u)
+	if err != nil {
+		return "", &validationError{url: u, reason: err.Error()}
+	}
+
+	var marker []byte
+	switch ft {
+	case ".jpg":
+		marker = jpegEOI
+	case ".png":
+		marker = pngIEND
+	}
+
+	if marker != nil {
+		ok, err := hasTrailer(path, marker)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", &validationError{url: u, reason: fmt.Sprintf("%s end marker not found, file truncated", ft)}
+		}
+	}
+
+	err = decodeImage(path)
+	if err != nil {
+		return "", &validationError{url: u, reason: err.Error()}
+	}
+	return ft, nil
+}
+
+// hasTrailer 检查文件尾部是否包含结束标记。
+func hasTrailer(path string, marker []byte) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	st, err := f.Stat()
+	if err != nil {
+		return false, err
+	}
+
+	off := st.Size() - tailSize
+	if off < 0 {
+		off = 0
+	}
+
+	tail := make([]byte, st.Size()-off)
+	_, err = f.ReadAt(tail, off)
+	if err != nil && err != io.EOF {
+		return false, err
+	}
+	return bytes.Contains(tail, marker), nil
+}
+
+// decodeImage 完整解码一次图片，确认数据没有损坏，没有对应解码器的类型直接通过。
+func decodeImage(path string) error {
+	c, err := imageConfig(path)
+	if errors.Is(err, image.ErrFormat) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	n := memory.acquire(int64(c.Width) * int64(c.Height) * 4)
+	defer memory.release(n)
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func(f *os.File) {
+		_ = f.Close()
+	}(f)
+
+	_, _, err = image.Decode(f)
+	return err
+}
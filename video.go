@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// VideoFilter 视频的过滤规则，不满足的视频不保存。0表示未配置，账号中未配置的项使用全局配置，负数表示不限制。
+type VideoFilter struct {
+	MinDuration time.Duration `yaml:"min_duration,omitempty"`
+	MinHeight   int           `yaml:"min_height,omitempty"`
+	MaxSizeMB   int64         `yaml:"max_size_mb,omitempty"`
+}
+
+func (f VideoFilter) merge(o VideoFilter) VideoFilter {
+	if o.MinDuration != 0 {
+		f.MinDuration = o.MinDuration
+	}
+	if o.MinHeight != 0 {
+		f.MinHeight = o.MinHeight
+	}
+	if o.MaxSizeMB != 0 {
+		f.MaxSizeMB = o.MaxSizeMB
+	}
+	return f
+}
+
+// check 返回视频被过滤的原因，通过时返回空；v为nil表示无法解析，只检查文件大小，时长为0表示未知，不检查时长。
+func (f VideoFilter) check(size int64, v *videoInfo) string {
+	if f.MaxSizeMB > 0 && size > f.MaxSizeMB*1048576 {
+		return fmt.Sprintf("size %d bytes larger than %dMB", size, f.MaxSizeMB)
+	}
+
+	if v == nil {
+		return ""
+	}
+
+	if f.MinDuration > 0 && v.Duration > 0 && v.Duration < f.MinDuration {
+		return fmt.Sprintf("duration %s shorter than %s", v.Duration, f.MinDuration)
+	}
+
+	if f.MinHeight > 0 && v.Height < f.MinHeight {
+		return fmt.Sprintf("height %d lower than %d", v.Height, f.MinHeight)
+	}
+	return ""
+}
+
+// video 返回被丢弃的视频记录下来的信息，没有解析出视频信息时返回nil。
+func (r *Record) video() *videoInfo {
+	if r.Width == 0 && r.Height == 0 && r.Duration == 0 && r.Codec == "" {
+		return nil
+	}
+	return &videoInfo{
+		Duration: time.Duration(r.Duration * float64(time.Second)),
+		Width:    r.Width,
+		Height:   r.Height,
+		Codec:    r.Codec,
+	}
+}
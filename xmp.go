@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"strings"
+	"time"
+)
+
+// XMP元数据的写入方式。
+const (
+	// XmpEmbed 写入JPEG的APP1段或PNG的iTXt块，不支持内嵌的类型改为写sidecar文件。
+	XmpEmbed = "embed"
+	// XmpSidecar 在文件旁生成原文件名加.xmp的文件，如a.jpg.xmp。
+	XmpSidecar = "sidecar"
+)
+
+const (
+	xmpNamespace = "http://ns.adobe.com/xap/1.0/\x00"
+	xmpPngKey    = "XML:com.adobe.xmp"
+)
+
+var pngSignature = []byte{0x89, 0x50, 0x4E, 0x47, 0x0D, 0x0A, 0x1A, 0x0A}
+
+func checkXmpMode(mode string) error {
+	switch mode {
+	case "", XmpEmbed, XmpSidecar:
+		return nil
+	}
+	return fmt.Errorf("invalid xmp: %q", mode)
+}
+
+func xmlEscape(s string) string {
+	b := new(bytes.Buffer)
+	_ = xml.EscapeText(b, []byte(s))
+	return b.String()
+}
+
+// buildXmp 生成包含描述、作者、hashtag、来源链接和发布时间的XMP packet。
+func buildXmp(item *oneItem, user *OneUser) []byte {
+	source := item.link
+	if source == "" {
+		source = item.url
+	}
+
+	b := new(strings.Builder)
+	b.WriteString("<?xpacket begin=\"\ufeff\" id=\"W5M0MpCehiHzreSzNTczkc9d\"?>\n")
+	b.WriteString("<x:xmpmeta xmlns:x=\"adobe:ns:meta/\">\n")
+	b.WriteString(" <rdf:RDF xmlns:rdf=\"http://www.w3.org/1999/02/22-rdf-syntax-ns#\">\n")
+	b.WriteString("  <rdf:Description rdf:about=\"\"\n")
+	b.WriteString("    xmlns:dc=\"http://purl.org/dc/elements/1.1/\"\n")
+	b.WriteString("    xmlns:xmp=\"http://ns.adobe.com/xap/1.0/\"")
+	if !item.published.IsZero() {
+		fmt.Fprintf(b, "\n    xmp:CreateDate=\"%s\"", item.published.Format(time.RFC3339))
+	}
+	b.WriteString(">\n")
+
+	if item.desc != "" {
+		fmt.Fprintf(b, "   <dc:description><rdf:Alt><rdf:li xml:lang=\"x-default\">%s</rdf:li></rdf:Alt></dc:description>\n", xmlEscape(item.desc))
+	}
+	fmt.Fprintf(b, "   <dc:creator><rdf:Seq><rdf:li>%s</rdf:li></rdf:Seq></dc:creator>\n", xmlEscape(user.account))
+	if len(item.hashtags) > 0 {
+		b.WriteString("   <dc:subject><rdf:Bag>")
+		for _, t := range item.hashtags {
+			fmt.Fprintf(b, "<rdf:li>%s</rdf:li>", xmlEscape(t))
+		}
+		b.WriteString("</rdf:Bag></dc:subject>\n")
+	}
+	fmt.Fprintf(b, "   <dc:source>%s</dc:source>\n", xmlEscape(source))
+
+	b.WriteString("  </rdf:Description>\n")
+	b.WriteString(" </rdf:RDF>\n")
+	b.WriteString("</x:xmpmeta>\n")
+	b.WriteString("<?xpacket end=\"w\"?>")
+	return []byte(b.String())
+}
+
+// embedXmp 把XMP packet写入图片，替换原有的XMP。
+func embedXmp(pic []byte, ft string, packet []byte) ([]byte, error) {
+	switch ft {
+	case ".jpg":
+		return embedJpegXmp(pic, packet)
+	case ".png":
+		return embedPngXmp(pic, packet)
+	}
+	return pic, nil
+}
+
+// embedJpegXmp 把XMP写入APP1段，放在原有的APPn段（如EXIF）之后。
+func embedJpegXmp(pic, packet []byte) ([]byte, error) {
+	data := append([]byte(xmpNamespace), packet...)
+	if len(data)+2 > 0xFFFF {
+		return nil, fmt.Errorf("xmp packet too large: %d bytes", len(data))
+	}
+
+	if len(pic) < 2 || pic[0] != 0xFF || pic[1] != 0xD8 {
+		return nil, fmt.Errorf("not a jpeg file")
+	}
+
+	out := bytes.NewBuffer(make([]byte, 0, len(pic)+len(data)+4))
+	out.Write(pic[:2])
+	pos := 2
+	for pos+4 <= len(pic) && pic[pos] == 0xFF && pic[pos+1] >= 0xE0 && pic[pos+1] <= 0xEF {
+		end := pos + 2 + int(binary.BigEndian.Uint16(pic[pos+2:]))
+		if end > len(pic) {
+			return nil, fmt.Errorf("invalid jpeg segment at %d", pos)
+		}
+		if !(pic[pos+1] == 0xE1 && bytes.HasPrefix(pic[pos+4:end], []byte(xmpNamespace))) {
+			out.Write(pic[pos:end])
+		}
+		pos = end
+	}
+
+	out.Write([]byte{0xFF, 0xE1})
+	_ = binary.Write(out, binary.BigEndian, uint16(len(data)+2))
+	out.Write(data)
+	out.Write(pic[pos:])
+	return out.Bytes(), nil
+}
+
+// embedPngXmp 把XMP写入iTXt块，放在第一个IDAT之前。
+func embedPngXmp(pic, packet []byte) ([]byte, error) {
+	if !bytes.HasPrefix(pic, pngSignature) {
+		return nil, fmt.Errorf("not a png file")
+	}
+
+	// keyword、压缩标志、压缩方法、语言标签和翻译后的keyword，后两者为空。
+	data := append([]byte(xmpPngKey), 0, 0, 0, 0, 0)
+	data = append(data, packet...)
+
+	out := bytes.NewBuffer(make([]byte, 0, len(pic)+len(data)+12))
+	out.Write(pngSignature)
+	pos, inserted := len(pngSignature), false
+	for pos+12 <= len(pic) {
+		l := int(binary.BigEndian.Uint32(pic[pos:]))
+		end := pos + 12 + l
+		if end > len(pic) {
+			return nil, fmt.Errorf("invalid png chunk at %d", pos)
+		}
+
+		typ := string(pic[pos+4 : pos+8])
+		if typ == "IDAT" && !inserted {
+			writePngChunk(out, "iTXt", data)
+			inserted = true
+		}
+		if !(typ == "iTXt" && bytes.HasPrefix(pic[pos+8:end], append([]byte(xmpPngKey), 0))) {
+			out.Write(pic[pos:end])
+		}
+		pos = end
+	}
+
+	if !inserted {
+		return nil, fmt.Errorf("no IDAT chunk in png file")
+	}
+	out.Write(pic[pos:])
+	return out.Bytes(), nil
+}
+
+func writePngChunk(out *bytes.Buffer, typ string, data []byte) {
+	_ = binary.Write(out, binary.BigEndian, uint32(len(data)))
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write([]byte(typ))
+	_, _ = crc.Write(data)
+	out.WriteString(typ)
+	out.Write(data)
+	_ = binary.Write(out, binary.BigEndian, crc.Sum32())
+}